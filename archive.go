@@ -0,0 +1,67 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// archiveDayFmt is both the URL suffix and the file layout of a day's
+// archive, relative to /{river}/archive/ or the river's archive directory.
+const archiveDayFmt = "2006/01/02.js"
+
+// archivePath is where the archive for day is written.
+func (r *River) archivePath(day time.Time) string {
+	return filepath.Join(r.archiveDir, r.Name, filepath.FromSlash(day.Format(archiveDayFmt)))
+}
+
+// dayRiverJS builds the RiverJS for every item archived on day (UTC).
+func (r *River) dayRiverJS(day time.Time) (RiverJS, error) {
+	js := r.newRiverJS()
+	js.Metadata["archiveDate"] = day.Format("2006-01-02")
+	err := db.View(getDay(r.Name, day, &js))
+	return js, err
+}
+
+// ArchiveWorker writes each finished day to the archive directory, if
+// the river has one, checking once an hour.
+func (r *River) ArchiveWorker() {
+	if r.archiveDir == "" {
+		return
+	}
+
+	for {
+		yesterday := time.Now().UTC().AddDate(0, 0, -1)
+		if err := r.writeArchive(yesterday); err != nil {
+			errorLog.Printf("couldn't write %s archive for %s (%v)", r.Name, yesterday.Format("2006-01-02"), err)
+		}
+		time.Sleep(time.Hour)
+	}
+}
+
+// writeArchive writes the archive file for day unless it already exists.
+func (r *River) writeArchive(day time.Time) error {
+	fname := r.archivePath(day)
+	if _, err := os.Stat(fname); err == nil {
+		return nil
+	}
+
+	js, err := r.dayRiverJS(day)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	if err := writeRiverJS(&buf, js); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(fname), 0755); err != nil {
+		return err
+	}
+
+	logger.Printf("writing %s archive to %s", r.Name, fname)
+	return ioutil.WriteFile(fname, buf.Bytes(), 0644)
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha1"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// riverCache holds the encoded river until the next update is
+// committed. The bare JSON and the default callback are kept; other
+// callbacks are wrapped around the cached RiverJS on demand.
+type riverCache struct {
+	sync.Mutex
+	js        *RiverJS
+	responses map[string]*cachedResponse
+	modified  time.Time
+}
+
+// cachedResponse is an encoded response, plain and gzipped. It is never
+// modified once built.
+type cachedResponse struct {
+	body     []byte
+	gzipped  []byte
+	etag     string
+	modified time.Time
+}
+
+// invalidate drops the cached river, marking it as modified now.
+func (c *riverCache) invalidate() {
+	c.Lock()
+	defer c.Unlock()
+	c.js = nil
+	c.responses = nil
+	c.modified = time.Now()
+}
+
+// cachedRiver returns the river response wrapped in callback, encoding
+// it first if it isn't cached.
+func (r *River) cachedRiver(callback string) (*cachedResponse, error) {
+	c := &r.cache
+	c.Lock()
+	defer c.Unlock()
+
+	if response, ok := c.responses[callback]; ok {
+		return response, nil
+	}
+
+	if c.js == nil {
+		js := r.newRiverJS()
+		if err := db.View(getRiver(r.Name, &js)); err != nil {
+			return nil, err
+		}
+		c.js = &js
+		c.responses = make(map[string]*cachedResponse)
+	}
+
+	if c.modified.IsZero() {
+		c.modified = time.Now()
+	}
+
+	var body bytes.Buffer
+	if err := writeCallback(&body, callback, *c.js); err != nil {
+		return nil, err
+	}
+
+	response, err := newCachedResponse(body.Bytes(), c.modified)
+	if err != nil {
+		return nil, err
+	}
+
+	if callback == "" || callback == callbackName {
+		c.responses[callback] = response
+	}
+
+	return response, nil
+}
+
+func newCachedResponse(body []byte, modified time.Time) (*cachedResponse, error) {
+	var gzipped bytes.Buffer
+	gz := gzip.NewWriter(&gzipped)
+	gz.Write(body)
+	if err := gz.Close(); err != nil {
+		return nil, err
+	}
+
+	return &cachedResponse{
+		body:     body,
+		gzipped:  gzipped.Bytes(),
+		etag:     fmt.Sprintf("%x", sha1.Sum(body)),
+		modified: modified,
+	}, nil
+}
+
+// serve writes the response, gzipped if the client accepts it.
+// http.ServeContent takes care of If-None-Match, If-Modified-Since and
+// answering with 304s.
+func (c *cachedResponse) serve(w http.ResponseWriter, req *http.Request) {
+	body, etag := c.body, c.etag
+	if strings.Contains(req.Header.Get("Accept-Encoding"), "gzip") {
+		body, etag = c.gzipped, etag+"-gzip"
+		w.Header().Set("Content-Encoding", "gzip")
+	}
+
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set("ETag", `"`+etag+`"`)
+	http.ServeContent(w, req, "", c.modified, bytes.NewReader(body))
+}
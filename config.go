@@ -1,8 +1,13 @@
 package main
 
 import (
+	"fmt"
 	"github.com/naoina/toml"
+	"io/ioutil"
 	"os"
+	"strconv"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -11,25 +16,128 @@ const (
 	utcTimestampFmt   = "Mon, 02 Jan 2006 15:04:05 GMT"
 	localTimestampFmt = "Mon, 02 Jan 2006 15:04:05 MST"
 	callbackName      = "onGetRiverStream"
+	maxCallbackLength = 64
 	opmlDocs          = "http://dev.opml.org/spec2.html"
 	maxEventLog       = 250
 	maxCharCount      = 280
 	maxItems          = 5
 	maxFeedUpdates    = 100
+	maxArchiveItems   = 100 // items per page of river history
+	maxSearchResults  = 100 // items per page of search results
+	minTermLength     = 2   // shorter words aren't indexed
+	maxTermLength     = 64  // nor are longer ones
 	pollChange        = 0.1 // scale poll interval by this percentage
 	pollDefault       = time.Duration(1 * time.Hour)
 	pollMin           = time.Duration(5 * time.Minute)
 	pollMax           = time.Duration(1 * time.Hour)
+	defaultWorkers    = 4  // fetch workers per river
+	defaultMaxWorkers = 16 // concurrent fetches across all rivers
+	defaultHostLimit  = 2  // concurrent fetches against a single host
+
+	// Titles with fewer words aren't distinctive enough to dedup on.
+	// Stories only count as duplicates within defaultDedupHours, so
+	// recurring posts like weekly roundups aren't suppressed forever.
+	minDedupTitleTerms = 4
+	defaultDedupHours  = 48
+
+	// Items revised in place keep this many earlier versions
+	maxRevisions = 10
+
+	// Fingerprints of items not seen in a feed for this many days are
+	// forgotten by the daily garbage collection.
+	defaultFingerprintDays = 90
+	gcInterval             = time.Duration(24 * time.Hour)
+
+	// Failed fetches back off exponentially from backoffMin to
+	// backoffMax. Feeds that 404 or 410 this many times in a row are
+	// parked.
+	backoffMin           = time.Duration(5 * time.Minute)
+	backoffMax           = time.Duration(24 * time.Hour)
+	maxPermanentFailures = 5
+
+	// Webhook deliveries are retried with the same kind of backoff,
+	// and given up on after maxWebhookAttempts.
+	webhookRetryMin    = time.Duration(30 * time.Second)
+	webhookRetryMax    = time.Duration(6 * time.Hour)
+	webhookPoll        = time.Duration(1 * time.Minute)
+	maxWebhookAttempts = 10
+
+	// Feeds pushed to us over WebSub are still polled, just rarely, and
+	// their subscriptions renewed once they're within websubRenew of
+	// expiring.
+	websubLease = time.Duration(10 * 24 * time.Hour)
+	websubRenew = time.Duration(24 * time.Hour)
+	websubPoll  = time.Duration(6 * time.Hour)
+	hubMaxLease = time.Duration(30 * 24 * time.Hour)
+
+	// rssCloud servers forget registrations after 25 hours. Renewal
+	// waits for a fetch, which can be websubPoll away once the feed is
+	// pushed, so it starts that long (and an hour more) before expiry.
+	rssCloudExpiry = time.Duration(25 * time.Hour)
+	rssCloudRenew  = rssCloudExpiry - websubPoll - time.Duration(1*time.Hour)
 )
 
 type Config struct {
-	River []struct {
-		Name        string
-		Title       string
-		Description string
-		Feeds       []string
-		OPML        string
-	}
+	MaxWorkers      int
+	HostLimit       int
+	ArchiveDir      string // default for rivers that don't set their own
+	FingerprintDays int    // ditto
+	BaseURL         string // public URL colorado is served from
+	River           []RiverConfig
+}
+
+type RiverConfig struct {
+	Name        string
+	Title       string
+	Description string
+	Feeds       []string
+	OPML        string
+	Workers     int
+	ArchiveDir  string // where finished days are written, if anywhere
+
+	// FingerprintDays is how long an item can go unseen before it's
+	// forgotten, and would be new again if it reappeared.
+	FingerprintDays int
+
+	// RewriteRedirects replaces permanently redirected feed URLs in
+	// the config file with their new location.
+	RewriteRedirects bool
+
+	Webhook []WebhookConfig
+	Filter  []FilterConfig
+
+	// Dedup drops ("suppress") items whose normalized link or title
+	// matches one already in the river, or attaches them to it
+	// ("group"). Off when empty. Only items from the last DedupHours
+	// are matched.
+	Dedup      string
+	DedupHours int
+
+	// Edits re-publishes items whose title or body changed as updated
+	// ("republish"), or revises them in place, keeping the earlier
+	// versions ("revisions"). Edits are ignored when empty.
+	Edits string
+}
+
+// WebhookConfig is a URL that's POSTed each new feed update, signed
+// with Secret.
+type WebhookConfig struct {
+	URL    string
+	Secret string
+}
+
+// FilterConfig is a rule keeping items out of a river. Items matching
+// an exclude rule are dropped; if a feed has include rules, only items
+// matching one of them are kept. A rule matches when any of its Keywords
+// (case-insensitive) or Regex is found in any of its Fields ("title",
+// "body", "link" or "author", all by default). It covers only Feeds, if
+// given, and every feed in the river otherwise.
+type FilterConfig struct {
+	Action   string // "include" or "exclude" (the default)
+	Keywords []string
+	Regex    []string
+	Feeds    []string
+	Fields   []string
 }
 
 func loadConfig(path string) (*Config, error) {
@@ -45,5 +153,69 @@ func loadConfig(path string) (*Config, error) {
 		return nil, err
 	}
 
+	if config.MaxWorkers <= 0 {
+		config.MaxWorkers = defaultMaxWorkers
+	}
+	if config.HostLimit <= 0 {
+		config.HostLimit = defaultHostLimit
+	}
+	if config.FingerprintDays <= 0 {
+		config.FingerprintDays = defaultFingerprintDays
+	}
+	for i := range config.River {
+		if config.River[i].Workers <= 0 {
+			config.River[i].Workers = defaultWorkers
+		}
+		if config.River[i].ArchiveDir == "" {
+			config.River[i].ArchiveDir = config.ArchiveDir
+		}
+		if config.River[i].FingerprintDays <= 0 {
+			config.River[i].FingerprintDays = config.FingerprintDays
+		}
+		if _, err := newFilters(config.River[i].Filter); err != nil {
+			return nil, fmt.Errorf("river %s: %v", config.River[i].Name, err)
+		}
+		if config.River[i].DedupHours <= 0 {
+			config.River[i].DedupHours = defaultDedupHours
+		}
+		switch config.River[i].Dedup {
+		case "", "suppress", "group":
+		default:
+			return nil, fmt.Errorf("river %s: unknown dedup %q", config.River[i].Name, config.River[i].Dedup)
+		}
+		switch config.River[i].Edits {
+		case "", "republish", "revisions":
+		default:
+			return nil, fmt.Errorf("river %s: unknown edits %q", config.River[i].Name, config.River[i].Edits)
+		}
+	}
+
 	return &config, nil
 }
+
+// configMu serializes rewrites of the config file.
+var configMu sync.Mutex
+
+// rewriteConfig replaces the quoted feed URL from with to in the config
+// file. The watcher then picks up the change like any other edit.
+func rewriteConfig(from, to string) error {
+	configMu.Lock()
+	defer configMu.Unlock()
+
+	info, err := os.Stat(configPath)
+	if err != nil {
+		return err
+	}
+
+	raw, err := ioutil.ReadFile(configPath)
+	if err != nil {
+		return err
+	}
+
+	updated := strings.Replace(string(raw), strconv.Quote(from), strconv.Quote(to), -1)
+	if updated == string(raw) {
+		return nil
+	}
+
+	return ioutil.WriteFile(configPath, []byte(updated), info.Mode())
+}
@@ -8,16 +8,24 @@ import (
 	"net/http"
 	"os"
 	"path"
+	"strings"
 )
 
 type RiverContainer struct {
 	Rivers map[string]*River
+	hub    *Hub
 }
 
 func NewRiverContainer(config *Config) *RiverContainer {
 	rc := RiverContainer{
 		Rivers: make(map[string]*River),
 	}
+	limiter := newFetchLimiter(config.MaxWorkers, config.HostLimit)
+
+	// Acting as a hub needs a base URL to name topics by
+	if config.BaseURL != "" {
+		rc.hub = NewHub(strings.TrimSuffix(config.BaseURL, "/"), rc.Rivers)
+	}
 
 	for _, obj := range config.River {
 		var (
@@ -35,7 +43,10 @@ func NewRiverContainer(config *Config) *RiverContainer {
 			}
 		}
 
-		rc.Rivers[obj.Name] = NewRiver(obj.Name, obj.Title, obj.Description, feeds)
+		river := NewRiver(obj, feeds, limiter)
+		river.baseURL = strings.TrimSuffix(config.BaseURL, "/")
+		river.hub = rc.hub
+		rc.Rivers[obj.Name] = river
 	}
 
 	return &rc
@@ -63,15 +74,31 @@ func (rc *RiverContainer) Run() {
 	// Set up the index handler
 	mux.Handle("/", rc)
 
+	if rc.hub != nil {
+		mux.Handle("/hub", rc.hub)
+	}
+
 	if quickStart {
-		logger.Println("quick start requested, skipping initial feed check")
+		logger.Println("quick start requested, spreading initial feed checks over the poll interval")
 	}
 
 	for name, river := range rc.Rivers {
 		// register HTTP handlers
 		mux.HandleFunc(fmt.Sprintf("/%s/", name), river.serveIndex)
 		mux.HandleFunc(fmt.Sprintf("/%s/river", name), river.serveRiver)
+		mux.HandleFunc(fmt.Sprintf("/%s/river.json", name), river.serveRiverJSON)
+		mux.HandleFunc(fmt.Sprintf("/%s/river.js", name), river.serveRiverJS)
 		mux.HandleFunc(fmt.Sprintf("/%s/feeds.opml", name), river.serveFeedsOpml)
+		mux.HandleFunc(fmt.Sprintf("/%s/feeds", name), river.serveFeeds)
+		mux.HandleFunc(fmt.Sprintf("/%s/feeds.json", name), river.serveFeedsJSON)
+		mux.HandleFunc(fmt.Sprintf("/%s/archive/", name), river.serveArchive)
+		mux.HandleFunc(fmt.Sprintf("/%s/rss.xml", name), river.serveOutput("rss.xml"))
+		mux.HandleFunc(fmt.Sprintf("/%s/atom.xml", name), river.serveOutput("atom.xml"))
+		mux.HandleFunc(fmt.Sprintf("/%s/feed.json", name), river.serveOutput("feed.json"))
+		mux.HandleFunc(fmt.Sprintf("/%s/events", name), river.serveEvents)
+		mux.HandleFunc(fmt.Sprintf("/%s/websub", name), river.serveWebSub)
+		mux.HandleFunc(fmt.Sprintf("/%s/rsscloud", name), river.serveRSSCloud)
+		mux.HandleFunc(fmt.Sprintf("/%s/search", name), river.serveSearch)
 
 		// start fetching feeds
 		go river.Run()
@@ -129,33 +156,9 @@ func (rc *RiverContainer) UpdateRivers() error {
 			continue
 		}
 
-		newFeeds := make(map[string]bool)
-		river := rc.Rivers[obj.Name]
-
-		// Add any new feeds to river.Streams
-		for _, feed := range obj.Feeds {
-			newFeeds[feed] = true
-
-			if _, ok := river.Streams[feed]; !ok {
-				logger.Printf("adding %q to %s river", feed, river.Name)
-				river.Streams[feed] = true
-				river.UpdateSchedule[feed] = pollDefault
-				river.Updater <- feed
-			}
-		}
-
-		// Remove any feeds in river.Streams that are no longer in the config file
-		for feed, _ := range river.Streams {
-			if _, ok := newFeeds[feed]; !ok {
-				logger.Printf("removing %q from %s river", feed, river.Name)
-				if stopped := river.Timers[feed].Stop(); !stopped {
-					logger.Printf("problem stopping timer for %q", feed)
-				}
-				delete(river.Timers, feed)
-				delete(river.Streams, feed)
-			}
-		}
-
+		// The river's Run loop owns its feed maps, so it makes the
+		// changes itself between processing fetches.
+		rc.Rivers[obj.Name].feedChanges <- obj.Feeds
 	}
 
 	return nil
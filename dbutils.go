@@ -1,86 +1,617 @@
 package main
 
 import (
+	"bytes"
+	"encoding/binary"
 	"encoding/json"
 	"github.com/boltdb/bolt"
+	"math"
 	"net/http"
+	"regexp"
+	"sort"
 	"strconv"
+	"time"
 )
 
-// createBucket creates the bucket if it does not exist.
+// createBucket creates the river's bucket, and the buckets nested in it,
+// if they do not exist.
 func createBucket(name string) func(*bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
-		if _, err := tx.CreateBucketIfNotExists([]byte(name)); err != nil {
+		b, err := tx.CreateBucketIfNotExists([]byte(name))
+		if err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte("items")); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte("days")); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte("updates")); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte("webhooks")); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte("dedup")); err != nil {
+			return err
+		}
+		if _, err := b.CreateBucketIfNotExists([]byte("fingerprints")); err != nil {
 			return err
 		}
 		return nil
 	}
 }
 
-// updateRiver prepends the new feed update to the stored JSON.
+// itemKey encodes an item ID as a big-endian key so items sort by ID.
+func itemKey(id uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, id)
+	return key
+}
+
+// updateRiver appends the new feed update to the updates bucket.
 func updateRiver(name string, newUpdate *UpdatedFeed) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("updates"))
+		return appendUpdate(b, newUpdate)
+	}
+}
+
+// appendUpdate stores update under the next key of the updates bucket,
+// dropping whatever fell out of the maxFeedUpdates window.
+func appendUpdate(b *bolt.Bucket, update *UpdatedFeed) error {
+	seq, err := b.NextSequence()
+	if err != nil {
+		return err
+	}
+
+	raw, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	if err := b.Put(itemKey(seq), raw); err != nil {
+		return err
+	}
+
+	if seq > maxFeedUpdates {
+		return b.Delete(itemKey(seq - maxFeedUpdates))
+	}
+	return nil
+}
+
+// migrateRiver moves the updates stored in the old single "river" JSON
+// value into the updates bucket, oldest first.
+func migrateRiver(name string) func(*bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
 		var updates []*UpdatedFeed
 
-		// Get the JSON out of boltdb
 		b := tx.Bucket([]byte(name))
-		obj := b.Get([]byte("river"))
+		raw := b.Get([]byte("river"))
+		if raw == nil {
+			return nil
+		}
+		if err := json.Unmarshal(raw, &updates); err != nil {
+			return err
+		}
+
+		for i := len(updates) - 1; i >= 0; i-- {
+			if err := appendUpdate(b.Bucket([]byte("updates")), updates[i]); err != nil {
+				return err
+			}
+		}
+
+		return b.Delete([]byte("river"))
+	}
+}
+
+// dayKey is the key in the days bucket for the UTC day of t.
+func dayKey(t time.Time) []byte {
+	return []byte(t.UTC().Format("2006-01-02"))
+}
+
+// archiveItems stores each item of the update individually, keyed by its
+// ID, as a single-item *UpdatedFeed. Since IDs only go up, each day's
+// items are a contiguous range, so the days bucket only records the
+// first ID seen on each day.
+func archiveItems(name string, update *UpdatedFeed) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("items"))
+		days := tx.Bucket([]byte(name)).Bucket([]byte("days"))
+		today := dayKey(time.Now())
+		var lowest uint64
+
+		for _, item := range update.Items {
+			id, err := strconv.ParseUint(item.Id, 10, 64)
+			if err != nil {
+				return err
+			}
+
+			archived := *update
+			archived.Items = []*UpdatedFeedItem{item}
+			raw, err := json.Marshal(archived)
+			if err != nil {
+				return err
+			}
+
+			if err := b.Put(itemKey(id), raw); err != nil {
+				return err
+			}
+
+			if lowest == 0 || id < lowest {
+				lowest = id
+			}
+		}
+
+		if lowest > 0 && days.Get(today) == nil {
+			return days.Put(today, itemKey(lowest))
+		}
+		return nil
+	}
+}
+
+// getDay places every item archived on day, newest first, onto the
+// RiverJS struct.
+func getDay(name string, day time.Time, js *RiverJS) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		var (
+			updates []*UpdatedFeed
+			last    []byte
+		)
+
+		days := tx.Bucket([]byte(name)).Bucket([]byte("days")).Cursor()
+		key := dayKey(day)
+		k, first := days.Seek(key)
+		if !bytes.Equal(k, key) {
+			return nil
+		}
+		if _, next := days.Next(); next != nil {
+			last = next
+		}
 
-		// Decode the byte slice into a slice of *UpdateFeed and
-		// prepend the new update
-		if obj != nil {
-			json.Unmarshal(obj, &updates)
-			updates = append([]*UpdatedFeed{newUpdate}, updates...)
+		// Walk the day's range backwards so the newest comes first
+		c := tx.Bucket([]byte(name)).Bucket([]byte("items")).Cursor()
+		var v []byte
+		if last == nil {
+			k, v = c.Last()
+		} else if k, _ = c.Seek(last); k == nil {
+			k, v = c.Last()
 		} else {
-			updates = []*UpdatedFeed{newUpdate}
+			k, v = c.Prev()
 		}
 
-		// Trim the update slice down to size
-		if len(updates) > maxFeedUpdates {
-			updates = updates[:maxFeedUpdates]
+		for ; k != nil && bytes.Compare(k, first) >= 0; k, v = c.Prev() {
+			var archived UpdatedFeed
+			if err := json.Unmarshal(v, &archived); err != nil {
+				return err
+			}
+			updates = groupArchived(updates, &archived)
 		}
 
-		// Encode the new river object and update bolt with it
-		updatedRiver, err := json.Marshal(updates)
-		err = b.Put([]byte("river"), updatedRiver)
-		if err != nil {
-			return err
+		js.UpdatedFeeds.UpdatedFeed = updates
+		return nil
+	}
+}
+
+// groupArchived appends an archived item to updates, folding it into the
+// last update if both came from the same fetch of the same feed.
+func groupArchived(updates []*UpdatedFeed, archived *UpdatedFeed) []*UpdatedFeed {
+	if last := len(updates) - 1; last >= 0 && updates[last].URL == archived.URL && updates[last].LastUpdate == archived.LastUpdate {
+		updates[last].Items = append(updates[last].Items, archived.Items...)
+		return updates
+	}
+	return append(updates, archived)
+}
+
+// getArchive places up to limit archived items with IDs below before,
+// newest first, onto the RiverJS struct. Consecutive items from the same
+// feed update are grouped back together. A before of 0 starts from the
+// newest item.
+func getArchive(name string, before uint64, limit int, js *RiverJS) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		var updates []*UpdatedFeed
+		c := tx.Bucket([]byte(name)).Bucket([]byte("items")).Cursor()
+
+		var k, v []byte
+		if before == 0 {
+			k, v = c.Last()
+		} else if k, _ = c.Seek(itemKey(before)); k == nil {
+			k, v = c.Last()
+		} else {
+			k, v = c.Prev()
 		}
 
+		for n := 0; k != nil && n < limit; k, v = c.Prev() {
+			var archived UpdatedFeed
+			if err := json.Unmarshal(v, &archived); err != nil {
+				return err
+			}
+			n++
+			updates = groupArchived(updates, &archived)
+		}
+
+		js.UpdatedFeeds.UpdatedFeed = updates
 		return nil
 	}
 }
 
-// getRiver places the slice of *UpdateFeeds onto the RiverJS struct.
+// getRiver places the latest maxFeedUpdates *UpdatedFeeds, newest first,
+// onto the RiverJS struct.
 func getRiver(name string, js *RiverJS) func(*bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
 		var updates []*UpdatedFeed
+
+		c := tx.Bucket([]byte(name)).Bucket([]byte("updates")).Cursor()
+		for k, v := c.Last(); k != nil && len(updates) < maxFeedUpdates; k, v = c.Prev() {
+			var update UpdatedFeed
+			if err := json.Unmarshal(v, &update); err != nil {
+				return err
+			}
+			updates = append(updates, &update)
+		}
+
+		js.UpdatedFeeds.UpdatedFeed = updates
+		return nil
+	}
+}
+
+// createIndexBucket creates the river's bucket in the search index,
+// setting created if it didn't exist yet.
+func createIndexBucket(name string, created *bool) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		*created = tx.Bucket([]byte(name)) == nil
+		_, err := tx.CreateBucketIfNotExists([]byte(name))
+		return err
+	}
+}
+
+// termKey is the search index key recording that term appears in item id.
+// Keys for a term share the term and a NUL as a prefix, and sort by ID.
+func termKey(term string, id uint64) []byte {
+	return append([]byte(term+"\x00"), itemKey(id)...)
+}
+
+// indexItems adds the title and body words of every item of the updates
+// to the search index.
+func indexItems(name string, updates ...*UpdatedFeed) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(name))
-		raw := b.Get([]byte("river"))
-		json.Unmarshal(raw, &updates)
+		for _, update := range updates {
+			for _, item := range update.Items {
+				id, err := strconv.ParseUint(item.Id, 10, 64)
+				if err != nil {
+					return err
+				}
+				for _, term := range searchTerms(item.Title + " " + item.Body) {
+					if err := b.Put(termKey(term, id), []byte{}); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		return nil
+	}
+}
+
+// searchIndex sets ids to the IDs of items containing every one of terms,
+// limited to IDs in [lo, hi), newest first. A hi of 0 has no upper bound.
+func searchIndex(name string, terms []string, lo, hi uint64, ids *[]uint64) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		var matches map[uint64]bool
+
+		c := tx.Bucket([]byte(name)).Cursor()
+		for _, term := range terms {
+			prefix := []byte(term + "\x00")
+			found := make(map[uint64]bool)
+			for k, _ := c.Seek(termKey(term, lo)); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				id := binary.BigEndian.Uint64(k[len(prefix):])
+				if hi != 0 && id >= hi {
+					break
+				}
+				if matches == nil || matches[id] {
+					found[id] = true
+				}
+			}
+			matches = found
+		}
+
+		*ids = (*ids)[:0]
+		for id, _ := range matches {
+			*ids = append(*ids, id)
+		}
+		sort.Sort(sort.Reverse(byID(*ids)))
+		return nil
+	}
+}
+
+// dayRange sets lo and hi to the range of item IDs archived from since
+// through until, either of which may be zero to leave that end open.
+func dayRange(name string, since, until time.Time, lo, hi *uint64) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(name)).Bucket([]byte("days")).Cursor()
+
+		if !since.IsZero() {
+			if _, v := c.Seek(dayKey(since)); v != nil {
+				*lo = binary.BigEndian.Uint64(v)
+			} else {
+				// Nothing archived that recently
+				*lo = math.MaxUint64
+			}
+		}
+
+		if !until.IsZero() {
+			if _, v := c.Seek(dayKey(until.AddDate(0, 0, 1))); v != nil {
+				*hi = binary.BigEndian.Uint64(v)
+			}
+		}
+		return nil
+	}
+}
+
+// getItems places the archived items with the given IDs, in order, onto
+// the RiverJS struct.
+func getItems(name string, ids []uint64, js *RiverJS) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		var updates []*UpdatedFeed
+		b := tx.Bucket([]byte(name)).Bucket([]byte("items"))
+
+		for _, id := range ids {
+			raw := b.Get(itemKey(id))
+			if raw == nil {
+				continue
+			}
+			var archived UpdatedFeed
+			if err := json.Unmarshal(raw, &archived); err != nil {
+				return err
+			}
+			updates = groupArchived(updates, &archived)
+		}
+
 		js.UpdatedFeeds.UpdatedFeed = updates
 		return nil
 	}
 }
 
-// checkFingerprint determines whether the given fingerprint has been seen before.
-func checkFingerprint(name, fingerprint string, seen *bool) func(*bolt.Tx) error {
+// getAllItems places every archived item, oldest first, into updates.
+func getAllItems(name string, updates *[]*UpdatedFeed) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(name)).Bucket([]byte("items")).ForEach(func(k, v []byte) error {
+			var archived UpdatedFeed
+			if err := json.Unmarshal(v, &archived); err != nil {
+				return err
+			}
+			*updates = append(*updates, &archived)
+			return nil
+		})
+	}
+}
+
+// checkFingerprint determines whether the given fingerprint has been seen
+// before, placing what was recorded then in previous, and records that
+// it's been seen now with the content hash.
+func checkFingerprint(name, fingerprint, hash string, seen *bool, previous *Fingerprint) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("fingerprints"))
+		now := time.Now()
+
+		record := Fingerprint{FirstSeen: now}
+		raw := b.Get([]byte(fingerprint))
+		if raw != nil {
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return err
+			}
+		}
+		*seen = raw != nil
+		*previous = record
+		record.LastSeen = now
+		record.Hash = hash
+
+		raw, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(fingerprint), raw)
+	}
+}
+
+// setFingerprintID records the ID the item with fingerprint was
+// published under.
+func setFingerprintID(name, fingerprint, id string) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("fingerprints"))
+		var record Fingerprint
+		if raw := b.Get([]byte(fingerprint)); raw != nil {
+			if err := json.Unmarshal(raw, &record); err != nil {
+				return err
+			}
+		}
+		record.ID = id
+
+		raw, err := json.Marshal(record)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte(fingerprint), raw)
+	}
+}
+
+// migrateFingerprintBucket moves fingerprints stored directly in the
+// river's bucket into the fingerprints bucket, as first seen now. They
+// are the only keys stored with a value of 1 besides the markers.
+func migrateFingerprintBucket(name string) func(*bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(name))
-		result := b.Get([]byte(fingerprint))
-		if result != nil {
-			*seen = true
-		} else {
-			*seen = false
-			err := b.Put([]byte(fingerprint), []byte{1})
-			if err != nil {
+		var keys [][]byte
+
+		b.ForEach(func(k, v []byte) error {
+			if bytes.Equal(v, []byte{1}) && !bytes.HasPrefix(k, []byte("reseed:")) && !bytes.HasPrefix(k, []byte("migrated:")) {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if len(keys) == 0 {
+			return nil
+		}
+
+		now := time.Now()
+		raw, err := json.Marshal(Fingerprint{FirstSeen: now, LastSeen: now})
+		if err != nil {
+			return err
+		}
+
+		fingerprints := b.Bucket([]byte("fingerprints"))
+		for _, k := range keys {
+			if err := fingerprints.Put(k, raw); err != nil {
+				return err
+			}
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// collectFingerprints deletes fingerprints last seen before cutoff,
+// except those of feeds keyed on the stalled origins, which may just not
+// have been fetched lately. removed is set to how many were deleted.
+func collectFingerprints(name string, cutoff time.Time, stalled []string, removed *int) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("fingerprints"))
+		var keys [][]byte
+
+		err := b.ForEach(func(k, v []byte) error {
+			for _, origin := range stalled {
+				if bytes.HasPrefix(k, []byte(origin+":")) {
+					return nil
+				}
+			}
+
+			var record Fingerprint
+			if err := json.Unmarshal(v, &record); err != nil {
+				return err
+			}
+			if record.LastSeen.Before(cutoff) {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
 				return err
 			}
 		}
+		*removed = len(keys)
 		return nil
 	}
 }
 
+// feedKeyPrefixes are the prefixes of the per-feed state kept in the
+// river's bucket, which can go once the feed is removed. Redirects and
+// origins are kept, since they tie a rewritten feed to its old URL.
+var feedKeyPrefixes = []string{"schedule:", "status:", "lastModified:", "etag:", "websub:", "rsscloud:"}
+
+// deleteFeedKeys removes the per-feed state stored for url.
+func deleteFeedKeys(name, url string) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		for _, prefix := range feedKeyPrefixes {
+			if err := b.Delete([]byte(prefix + url)); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// pruneFeedKeys removes the per-feed state stored for any feed not in
+// feeds, such as those dropped from the config while we weren't running.
+// removed is set to how many keys were deleted.
+func pruneFeedKeys(name string, feeds map[string]bool, removed *int) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		var keys [][]byte
+
+		c := b.Cursor()
+		for _, prefix := range feedKeyPrefixes {
+			for k, _ := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, _ = c.Next() {
+				if !feeds[string(k[len(prefix):])] {
+					keys = append(keys, k)
+				}
+			}
+		}
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		*removed = len(keys)
+		return nil
+	}
+}
+
+// randomFingerprint matches the uuid.NewV4 GUIDs that items without a
+// GUID or link were once fingerprinted with.
+var randomFingerprint = regexp.MustCompile(`^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$`)
+
+// migrateFingerprints deletes the random fingerprints of the feeds keyed
+// on origins, and marks those feeds for reseeding with content hashes.
+// It only runs once per river.
+func migrateFingerprints(name string, origins []string) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if b.Get([]byte("migrated:fingerprints")) != nil {
+			return nil
+		}
+
+		for _, origin := range origins {
+			prefix := []byte(origin + ":")
+			var random [][]byte
+
+			c := b.Cursor()
+			for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+				if randomFingerprint.Match(k[len(prefix):]) {
+					random = append(random, k)
+				}
+			}
+
+			for _, k := range random {
+				if err := b.Delete(k); err != nil {
+					return err
+				}
+			}
+			if len(random) > 0 {
+				if err := b.Put([]byte("reseed:"+origin), []byte{1}); err != nil {
+					return err
+				}
+			}
+		}
+
+		return b.Put([]byte("migrated:fingerprints"), []byte{1})
+	}
+}
+
+// getReseed sets reseed if the feed keyed on origin had its random
+// fingerprints migrated and hasn't been fetched since.
+func getReseed(name, origin string, reseed *bool) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		*reseed = tx.Bucket([]byte(name)).Get([]byte("reseed:"+origin)) != nil
+		return nil
+	}
+}
+
+// deleteReseed clears the reseed mark of the feed keyed on origin.
+func deleteReseed(name, origin string) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		return tx.Bucket([]byte(name)).Delete([]byte("reseed:" + origin))
+	}
+}
+
 // getCacheHeaders gets Last-Modified and ETag out of boltdb.
 func getCacheHeaders(name, url string, req *http.Request) func(*bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
@@ -109,6 +640,96 @@ func setCacheHeaders(name, url string, resp *http.Response) func(*bolt.Tx) error
 	}
 }
 
+// getSchedule loads the stored poll schedule for url, leaving schedule
+// untouched if none has been stored yet.
+func getSchedule(name, url string, schedule *FeedSchedule) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		raw := b.Get([]byte("schedule:" + url))
+		if raw == nil {
+			return nil
+		}
+		return json.Unmarshal(raw, schedule)
+	}
+}
+
+// setSchedule stores the poll schedule for url.
+func setSchedule(name, url string, schedule *FeedSchedule) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		raw, err := json.Marshal(schedule)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("schedule:"+url), raw)
+	}
+}
+
+// getRedirect sets target to where url has permanently moved, leaving it
+// untouched if it hasn't.
+func getRedirect(name, url string, target *string) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if moved := b.Get([]byte("redirect:" + url)); moved != nil {
+			*target = string(moved)
+		}
+		return nil
+	}
+}
+
+// setRedirect records that url has permanently moved to movedTo, and
+// that movedTo originally came from url (or wherever url came from).
+func setRedirect(name, url, movedTo string) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		origin := url
+		if o := b.Get([]byte("origin:" + url)); o != nil {
+			origin = string(o)
+		}
+		if err := b.Put([]byte("redirect:"+url), []byte(movedTo)); err != nil {
+			return err
+		}
+		return b.Put([]byte("origin:"+movedTo), []byte(origin))
+	}
+}
+
+// getOrigin sets origin to the URL url was first subscribed at, leaving
+// it untouched if url was never the target of a redirect.
+func getOrigin(name, url string, origin *string) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		if o := b.Get([]byte("origin:" + url)); o != nil {
+			*origin = string(o)
+		}
+		return nil
+	}
+}
+
+// getStatus loads the stored status for url, leaving status untouched if
+// the feed hasn't been fetched yet.
+func getStatus(name, url string, status *FeedStatus) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		raw := b.Get([]byte("status:" + url))
+		if raw == nil {
+			return nil
+		}
+		return json.Unmarshal(raw, status)
+	}
+}
+
+// setStatus stores the status for url.
+func setStatus(name, url string, status *FeedStatus) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		raw, err := json.Marshal(status)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("status:"+url), raw)
+	}
+}
+
 func assignNextID(name string, update *UpdatedFeedItem) func(*bolt.Tx) error {
 	return func(tx *bolt.Tx) error {
 		b := tx.Bucket([]byte(name))
@@ -120,3 +741,290 @@ func assignNextID(name string, update *UpdatedFeedItem) func(*bolt.Tx) error {
 		return nil
 	}
 }
+
+// dedupKey is the value stored under a dedup key: the item the key was
+// first seen on, and when.
+type dedupKey struct {
+	ID   uint64    `json:"id"`
+	Seen time.Time `json:"seen"`
+}
+
+// findDuplicate sets id to the item seen since since under any of keys,
+// leaving it 0 if none was. Keys stored before they were timestamped
+// never match.
+func findDuplicate(name string, keys []string, since time.Time, id *uint64) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("dedup"))
+		for _, key := range keys {
+			var stored dedupKey
+			if raw := b.Get([]byte(key)); raw == nil || json.Unmarshal(raw, &stored) != nil {
+				continue
+			}
+			if stored.Seen.After(since) {
+				*id = stored.ID
+				return nil
+			}
+		}
+		return nil
+	}
+}
+
+// setDuplicateKeys records keys as identifying item id, seen now.
+func setDuplicateKeys(name string, keys []string, id uint64) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("dedup"))
+		raw, err := json.Marshal(dedupKey{ID: id, Seen: time.Now()})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			if err := b.Put([]byte(key), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// collectDuplicateKeys deletes dedup keys seen before cutoff, which can
+// no longer match. removed is set to how many were deleted.
+func collectDuplicateKeys(name string, cutoff time.Time, removed *int) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("dedup"))
+		var keys [][]byte
+
+		b.ForEach(func(k, v []byte) error {
+			var stored dedupKey
+			if json.Unmarshal(v, &stored) != nil || stored.Seen.Before(cutoff) {
+				keys = append(keys, k)
+			}
+			return nil
+		})
+
+		for _, k := range keys {
+			if err := b.Delete(k); err != nil {
+				return err
+			}
+		}
+		*removed = len(keys)
+		return nil
+	}
+}
+
+// addDuplicate attaches dup to item id.
+func addDuplicate(name string, id uint64, dup *Duplicate) func(*bolt.Tx) error {
+	return editItem(name, id, func(item *UpdatedFeedItem) {
+		// An edited duplicate replaces its earlier version
+		for i, existing := range item.Duplicates {
+			if existing.FeedURL == dup.FeedURL && existing.Link == dup.Link {
+				item.Duplicates[i] = dup
+				return
+			}
+		}
+		item.Duplicates = append(item.Duplicates, dup)
+	})
+}
+
+// editItem applies edit to item id in the archive and, if it's still
+// there, in the river.
+func editItem(name string, id uint64, edit func(*UpdatedFeedItem)) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		items := tx.Bucket([]byte(name)).Bucket([]byte("items"))
+		if raw := items.Get(itemKey(id)); raw != nil {
+			var archived UpdatedFeed
+			if err := json.Unmarshal(raw, &archived); err != nil {
+				return err
+			}
+			for _, item := range archived.Items {
+				edit(item)
+			}
+			raw, err := json.Marshal(archived)
+			if err != nil {
+				return err
+			}
+			if err := items.Put(itemKey(id), raw); err != nil {
+				return err
+			}
+		}
+
+		// The river is only maxFeedUpdates long, so look through it
+		updates := tx.Bucket([]byte(name)).Bucket([]byte("updates"))
+		target := strconv.FormatUint(id, 10)
+		c := updates.Cursor()
+		for k, v := c.Last(); k != nil; k, v = c.Prev() {
+			var update UpdatedFeed
+			if err := json.Unmarshal(v, &update); err != nil {
+				return err
+			}
+			for _, item := range update.Items {
+				if item.Id != target {
+					continue
+				}
+				edit(item)
+				raw, err := json.Marshal(update)
+				if err != nil {
+					return err
+				}
+				return updates.Put(k, raw)
+			}
+		}
+		return nil
+	}
+}
+
+// enqueueWebhook adds a delivery to the river's webhook queue.
+func enqueueWebhook(name string, delivery *webhookDelivery) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("webhooks"))
+		id, err := b.NextSequence()
+		if err != nil {
+			return err
+		}
+		delivery.ID = id
+		raw, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		return b.Put(itemKey(id), raw)
+	}
+}
+
+// dueWebhooks collects the queued deliveries due to be attempted by now.
+func dueWebhooks(name string, now time.Time, due *[]*webhookDelivery) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("webhooks"))
+		return b.ForEach(func(k, v []byte) error {
+			var delivery webhookDelivery
+			if err := json.Unmarshal(v, &delivery); err != nil {
+				return err
+			}
+			if !delivery.NextAttempt.After(now) {
+				delivery.ID = binary.BigEndian.Uint64(k)
+				*due = append(*due, &delivery)
+			}
+			return nil
+		})
+	}
+}
+
+// updateWebhook stores a delivery back in the queue after a failed attempt.
+func updateWebhook(name string, delivery *webhookDelivery) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("webhooks"))
+		raw, err := json.Marshal(delivery)
+		if err != nil {
+			return err
+		}
+		return b.Put(itemKey(delivery.ID), raw)
+	}
+}
+
+// deleteWebhook removes a delivery from the queue.
+func deleteWebhook(name string, id uint64) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name)).Bucket([]byte("webhooks"))
+		return b.Delete(itemKey(id))
+	}
+}
+
+// getSubscription loads the WebSub subscription for url, leaving sub nil
+// if there isn't one.
+func getSubscription(name, url string, sub **Subscription) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		raw := b.Get([]byte("websub:" + url))
+		if raw == nil {
+			return nil
+		}
+		*sub = new(Subscription)
+		return json.Unmarshal(raw, *sub)
+	}
+}
+
+// setSubscription stores the WebSub subscription for url.
+func setSubscription(name, url string, sub *Subscription) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		raw, err := json.Marshal(sub)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("websub:"+url), raw)
+	}
+}
+
+// deleteSubscription removes the WebSub subscription for url.
+func deleteSubscription(name, url string) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		return b.Delete([]byte("websub:" + url))
+	}
+}
+
+// getCloudRegistration loads the rssCloud registration for url, leaving
+// reg nil if there isn't one.
+func getCloudRegistration(name, url string, reg **CloudRegistration) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		raw := b.Get([]byte("rsscloud:" + url))
+		if raw == nil {
+			return nil
+		}
+		*reg = new(CloudRegistration)
+		return json.Unmarshal(raw, *reg)
+	}
+}
+
+// setCloudRegistration stores the rssCloud registration for url.
+func setCloudRegistration(name, url string, reg *CloudRegistration) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		raw, err := json.Marshal(reg)
+		if err != nil {
+			return err
+		}
+		return b.Put([]byte("rsscloud:"+url), raw)
+	}
+}
+
+// createHubBucket creates the bucket hub subscribers are kept in.
+func createHubBucket(tx *bolt.Tx) error {
+	_, err := tx.CreateBucketIfNotExists([]byte(hubBucket))
+	return err
+}
+
+// setHubSubscriber stores a verified hub subscriber.
+func setHubSubscriber(sub *HubSubscriber) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(hubBucket))
+		raw, err := json.Marshal(sub)
+		if err != nil {
+			return err
+		}
+		return b.Put(sub.key(), raw)
+	}
+}
+
+// deleteHubSubscriber removes a hub subscriber.
+func deleteHubSubscriber(sub *HubSubscriber) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(hubBucket))
+		return b.Delete(sub.key())
+	}
+}
+
+// getHubSubscribers collects the subscribers to any topic starting with
+// prefix.
+func getHubSubscribers(prefix string, subs *[]*HubSubscriber) func(*bolt.Tx) error {
+	return func(tx *bolt.Tx) error {
+		c := tx.Bucket([]byte(hubBucket)).Cursor()
+		for k, v := c.Seek([]byte(prefix)); k != nil && bytes.HasPrefix(k, []byte(prefix)); k, v = c.Next() {
+			var sub HubSubscriber
+			if err := json.Unmarshal(v, &sub); err != nil {
+				return err
+			}
+			*subs = append(*subs, &sub)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"github.com/mmcdole/gofeed"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Duplicate is an item from another feed (or a later copy from the same
+// one) grouped under the first item of the same story.
+type Duplicate struct {
+	FeedURL   string `json:"feedUrl"`
+	FeedTitle string `json:"feedTitle"`
+	Title     string `json:"title"`
+	Link      string `json:"link"`
+	PubDate   string `json:"pubDate"`
+}
+
+// trackingParams are query parameters stripped from links before
+// comparing them. Any parameter starting with utm_ is stripped too.
+var trackingParams = map[string]bool{
+	"fbclid":  true,
+	"gclid":   true,
+	"dclid":   true,
+	"msclkid": true,
+	"mc_cid":  true,
+	"mc_eid":  true,
+	"igshid":  true,
+	"ref":     true,
+}
+
+// normalizeLink reduces link to the parts that identify the page: the
+// host without "www.", the path without a trailing slash, and the sorted
+// query minus tracking parameters. The scheme and fragment are dropped.
+func normalizeLink(link string) string {
+	u, err := url.Parse(strings.TrimSpace(link))
+	if err != nil || u.Host == "" {
+		return ""
+	}
+
+	query := u.Query()
+	for param, _ := range query {
+		if strings.HasPrefix(strings.ToLower(param), "utm_") || trackingParams[strings.ToLower(param)] {
+			query.Del(param)
+		}
+	}
+
+	host := strings.TrimPrefix(strings.ToLower(u.Host), "www.")
+	normalized := host + strings.TrimSuffix(u.EscapedPath(), "/")
+	if encoded := query.Encode(); encoded != "" {
+		normalized += "?" + encoded
+	}
+	return normalized
+}
+
+// titleSeparators split a headline from the site name many feeds tack
+// on, as in "Story title - BBC News".
+var titleSeparators = []string{" - ", " | ", " — ", " – ", " :: "}
+
+// normalizeTitle reduces title to its lowercased words, after dropping
+// any site name around it, so near-identical headlines compare equal.
+// Titles too short to be distinctive normalize to "".
+func normalizeTitle(title string) string {
+	title = makePlainText(title)
+
+	// Keep the longest segment, which is the headline itself
+	segments := []string{title}
+	for _, sep := range titleSeparators {
+		var split []string
+		for _, segment := range segments {
+			split = append(split, strings.Split(segment, sep)...)
+		}
+		segments = split
+	}
+	headline := segments[0]
+	for _, segment := range segments[1:] {
+		if len(segment) > len(headline) {
+			headline = segment
+		}
+	}
+
+	terms := searchTerms(headline)
+	if len(terms) < minDedupTitleTerms {
+		return ""
+	}
+	return strings.Join(terms, " ")
+}
+
+// dedupKeys returns the keys an item is recognized by across feeds.
+func dedupKeys(item *gofeed.Item) []string {
+	var keys []string
+	if link := normalizeLink(item.Link); link != "" {
+		keys = append(keys, "link:"+link)
+	}
+	if title := normalizeTitle(item.Title); title != "" {
+		keys = append(keys, "title:"+title)
+	}
+	return keys
+}
+
+// groupDuplicate attaches dup to the item with the given ID, whether it's
+// one of the pending items of this fetch or already stored.
+func (r *River) groupDuplicate(id uint64, dup *Duplicate, pending *UpdatedFeed) {
+	for _, item := range pending.Items {
+		if item.Id == strconv.FormatUint(id, 10) {
+			item.Duplicates = append(item.Duplicates, dup)
+			return
+		}
+	}
+
+	if err := db.Update(addDuplicate(r.Name, id, dup)); err != nil {
+		errorLog.Printf("couldn't group duplicate %q under item %d in %s (%v)", dup.Link, id, r.Name, err)
+		return
+	}
+	r.cache.invalidate()
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"strconv"
+)
+
+// Revision is an earlier version of an item that was since edited.
+type Revision struct {
+	Title   string `json:"title"`
+	Body    string `json:"body"`
+	Revised string `json:"whenRevised"`
+}
+
+// reviseItem replaces the title and body of the published item id,
+// keeping the old ones as a revision. Edits that don't change what's
+// shown, like a comment count past where the body is truncated, are
+// ignored, and only the last maxRevisions revisions are kept.
+func (r *River) reviseItem(id, title, body string) {
+	parsed, err := strconv.ParseUint(id, 10, 64)
+	if err != nil {
+		errorLog.Printf("couldn't revise item %q in %s (%v)", id, r.Name, err)
+		return
+	}
+
+	var revised bool
+	revise := func(published *UpdatedFeedItem) {
+		if published.Title == title && published.Body == body {
+			return
+		}
+		published.Revisions = append(published.Revisions, &Revision{
+			Title:   published.Title,
+			Body:    published.Body,
+			Revised: nowGMT(),
+		})
+		if len(published.Revisions) > maxRevisions {
+			published.Revisions = published.Revisions[len(published.Revisions)-maxRevisions:]
+		}
+		published.Title = title
+		published.Body = body
+		published.Updated = true
+		revised = true
+	}
+
+	if err := db.Update(editItem(r.Name, parsed, revise)); err != nil {
+		errorLog.Printf("couldn't revise item %s in %s (%v)", id, r.Name, err)
+		return
+	}
+	if !revised {
+		return
+	}
+	r.cache.invalidate()
+	if r.hub != nil {
+		go r.hub.publish(r)
+	}
+
+	// Make the new wording searchable too
+	r.indexItems(&UpdatedFeed{Items: []*UpdatedFeedItem{{Id: id, Title: title, Body: body}}})
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// publishedItems returns every item published to river name, newest
+// first.
+func publishedItems(t *testing.T, name string) []*UpdatedFeedItem {
+	var js RiverJS
+	if err := db.View(getRiver(name, &js)); err != nil {
+		t.Fatal(err)
+	}
+
+	var items []*UpdatedFeedItem
+	for _, update := range js.UpdatedFeeds.UpdatedFeed {
+		items = append(items, update.Items...)
+	}
+	return items
+}
+
+func TestEditOfFilteredItem(t *testing.T) {
+	const (
+		name    = "edits-filtered"
+		feedURL = "http://example.com/feed"
+	)
+
+	r := NewRiver(RiverConfig{
+		Name:    name,
+		Workers: 1,
+		Edits:   "republish",
+		Filter:  []FilterConfig{{Keywords: []string{"draft"}}},
+	}, []string{feedURL}, nil)
+	defer func() {
+		for _, timer := range r.Timers {
+			timer.Stop()
+		}
+	}()
+
+	fetch := func(title string) {
+		feed := &gofeed.Feed{Items: []*gofeed.Item{{GUID: "plans", Title: title}}}
+		r.ProcessFeed(FetchResult{URL: feedURL, Feed: feed, StatusCode: http.StatusOK})
+	}
+
+	fetch("Draft plans for the week")
+	if items := publishedItems(t, name); len(items) != 0 {
+		t.Fatalf("published %d filtered item(s)", len(items))
+	}
+
+	// Once it passes the filter, it's new to readers
+	fetch("Plans for the week")
+	items := publishedItems(t, name)
+	if len(items) != 1 || items[0].Updated {
+		t.Fatalf("edit of filtered item published %d item(s), want one new item", len(items))
+	}
+	first := items[0].Id
+
+	// and further edits point back at it
+	fetch("Plans for the week, revised")
+	items = publishedItems(t, name)
+	if len(items) != 2 || !items[0].Updated || items[0].OriginalID != first {
+		t.Fatalf("second edit published as %+v, want an update of item %s", items[0], first)
+	}
+}
+
+func TestEditOfSuppressedDuplicate(t *testing.T) {
+	const (
+		name    = "edits-duplicate"
+		feedURL = "http://example.com/feed"
+	)
+
+	r := NewRiver(RiverConfig{
+		Name:       name,
+		Workers:    1,
+		Dedup:      "suppress",
+		DedupHours: defaultDedupHours,
+		Edits:      "republish",
+	}, []string{feedURL}, nil)
+	defer func() {
+		for _, timer := range r.Timers {
+			timer.Stop()
+		}
+	}()
+
+	original := &gofeed.Item{GUID: "original", Link: "http://example.com/story", Title: "Council approves the new budget"}
+	fetch := func(title string) {
+		copied := &gofeed.Item{GUID: "copy", Link: "http://example.com/story?utm_source=rss", Title: title}
+		feed := &gofeed.Feed{Items: []*gofeed.Item{copied, original}}
+		r.ProcessFeed(FetchResult{URL: feedURL, Feed: feed, StatusCode: http.StatusOK})
+	}
+
+	for _, title := range []string{"Council approves budget", "Council approves budget (updated)"} {
+		fetch(title)
+		if items := publishedItems(t, name); len(items) != 1 || items[0].Title != original.Title {
+			t.Fatalf("after %q published %d item(s), want only the original", title, len(items))
+		}
+	}
+}
+
+func TestReviseItem(t *testing.T) {
+	const (
+		name    = "edits-revisions"
+		feedURL = "http://example.com/feed"
+	)
+
+	r := NewRiver(RiverConfig{Name: name, Workers: 1, Edits: "revisions"}, []string{feedURL}, nil)
+	defer func() {
+		for _, timer := range r.Timers {
+			timer.Stop()
+		}
+	}()
+
+	fetch := func(title, description string) {
+		feed := &gofeed.Feed{Items: []*gofeed.Item{{GUID: "story", Title: title, Description: description}}}
+		r.ProcessFeed(FetchResult{URL: feedURL, Feed: feed, StatusCode: http.StatusOK})
+	}
+
+	fetch("Take 0", "Body")
+	for i := 1; i <= maxRevisions+5; i++ {
+		fetch(fmt.Sprintf("Take %d", i), "Body")
+	}
+
+	items := publishedItems(t, name)
+	if len(items) != 1 {
+		t.Fatalf("published %d item(s), want 1 revised in place", len(items))
+	}
+	revisions := items[0].Revisions
+	if len(revisions) != maxRevisions {
+		t.Fatalf("kept %d revision(s), want %d", len(revisions), maxRevisions)
+	}
+	if last := revisions[len(revisions)-1].Title; last != fmt.Sprintf("Take %d", maxRevisions+4) {
+		t.Errorf("last revision is %q, want the one before the current title", last)
+	}
+
+	// Changes past where the body is truncated aren't revisions
+	long := strings.Repeat("word ", maxCharCount/5+10)
+	fetch(fmt.Sprintf("Take %d", maxRevisions+5), long+"5 comments")
+	before := publishedItems(t, name)[0].Revisions
+	fetch(fmt.Sprintf("Take %d", maxRevisions+5), long+"6 comments")
+	after := publishedItems(t, name)[0].Revisions
+	if after[len(after)-1].Body != before[len(before)-1].Body {
+		t.Errorf("change past the truncated body added a revision")
+	}
+}
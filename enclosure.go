@@ -0,0 +1,73 @@
+package main
+
+import (
+	"github.com/mmcdole/gofeed"
+	"strconv"
+	"strings"
+)
+
+// Enclosure is a file attached to an item, such as a podcast episode.
+type Enclosure struct {
+	URL    string `json:"url"`
+	Type   string `json:"type,omitempty"`
+	Length int64  `json:"length,omitempty"`
+}
+
+// itemEnclosures returns the enclosures of item that have a URL.
+func itemEnclosures(item *gofeed.Item) []*Enclosure {
+	var enclosures []*Enclosure
+	for _, enclosure := range item.Enclosures {
+		if enclosure.URL == "" {
+			continue
+		}
+		length, _ := strconv.ParseInt(strings.TrimSpace(enclosure.Length), 10, 64)
+		enclosures = append(enclosures, &Enclosure{
+			URL:    enclosure.URL,
+			Type:   enclosure.Type,
+			Length: length,
+		})
+	}
+	return enclosures
+}
+
+// mimeType is the type of e for the RSS and JSON Feed outputs, which
+// both require one even when the source feed left it out.
+func (e *Enclosure) mimeType() string {
+	if e.Type == "" {
+		return "application/octet-stream"
+	}
+	return e.Type
+}
+
+// itemDuration returns the iTunes duration of item, if it has one.
+func itemDuration(item *gofeed.Item) string {
+	if item.ITunesExt != nil {
+		return strings.TrimSpace(item.ITunesExt.Duration)
+	}
+	return ""
+}
+
+// itemImage returns the artwork for item, preferring its iTunes image.
+func itemImage(item *gofeed.Item) string {
+	if item.ITunesExt != nil && item.ITunesExt.Image != "" {
+		return item.ITunesExt.Image
+	}
+	if item.Image != nil {
+		return item.Image.URL
+	}
+	return ""
+}
+
+// durationSeconds converts an iTunes duration, given as seconds, MM:SS or
+// HH:MM:SS, to seconds. It returns 0 if duration can't be parsed.
+func durationSeconds(duration string) int {
+	var seconds int
+	for _, part := range strings.Split(duration, ":") {
+		n, err := strconv.Atoi(part)
+		if err != nil {
+			return 0
+		}
+		seconds = seconds*60 + n
+	}
+	return seconds
+}
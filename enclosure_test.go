@@ -0,0 +1,81 @@
+package main
+
+import (
+	"github.com/mmcdole/gofeed"
+	"reflect"
+	"testing"
+)
+
+func TestDurationSeconds(t *testing.T) {
+	tests := []struct {
+		duration string
+		want     int
+	}{
+		{"3600", 3600},
+		{"1:00:00", 3600},
+		{"61:05", 3665},
+		{"0:45", 45},
+		{"", 0},
+		{"bad", 0},
+		{"1:bad", 0},
+	}
+
+	for _, test := range tests {
+		if got := durationSeconds(test.duration); got != test.want {
+			t.Errorf("durationSeconds(%q) = %d, want %d", test.duration, got, test.want)
+		}
+	}
+}
+
+func TestItemEnclosures(t *testing.T) {
+	tests := []struct {
+		name       string
+		enclosures []*gofeed.Enclosure
+		want       []*Enclosure
+	}{
+		{"none", nil, nil},
+		{
+			"complete",
+			[]*gofeed.Enclosure{{URL: "http://example.com/1.mp3", Type: "audio/mpeg", Length: "1024"}},
+			[]*Enclosure{{URL: "http://example.com/1.mp3", Type: "audio/mpeg", Length: 1024}},
+		},
+		{
+			"padded length",
+			[]*gofeed.Enclosure{{URL: "http://example.com/1.mp3", Type: "audio/mpeg", Length: " 1024\n"}},
+			[]*Enclosure{{URL: "http://example.com/1.mp3", Type: "audio/mpeg", Length: 1024}},
+		},
+		{
+			"bad length and no type",
+			[]*gofeed.Enclosure{{URL: "http://example.com/1.mp3", Length: "unknown"}},
+			[]*Enclosure{{URL: "http://example.com/1.mp3"}},
+		},
+		{
+			"no URL",
+			[]*gofeed.Enclosure{{Type: "audio/mpeg"}, {URL: "http://example.com/2.ogg", Type: "audio/ogg"}},
+			[]*Enclosure{{URL: "http://example.com/2.ogg", Type: "audio/ogg"}},
+		},
+	}
+
+	for _, test := range tests {
+		got := itemEnclosures(&gofeed.Item{Enclosures: test.enclosures})
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: itemEnclosures = %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestEnclosureMIMEType(t *testing.T) {
+	tests := []struct {
+		enclosure Enclosure
+		want      string
+	}{
+		{Enclosure{URL: "http://example.com/1.mp3", Type: "audio/mpeg"}, "audio/mpeg"},
+		{Enclosure{URL: "http://example.com/1.bin"}, "application/octet-stream"},
+	}
+
+	for _, test := range tests {
+		if got := test.enclosure.mimeType(); got != test.want {
+			t.Errorf("mimeType of %q = %q, want %q", test.enclosure.URL, got, test.want)
+		}
+	}
+}
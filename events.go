@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	eventBuffer    = 16               // updates queued per client before it's dropped
+	eventKeepalive = 30 * time.Second // comment sent to idle clients
+)
+
+// eventBroker fans new feed updates out to the river's /events clients.
+type eventBroker struct {
+	sync.Mutex
+	clients map[chan *UpdatedFeed]bool
+}
+
+func (b *eventBroker) subscribe() chan *UpdatedFeed {
+	b.Lock()
+	defer b.Unlock()
+
+	if b.clients == nil {
+		b.clients = make(map[chan *UpdatedFeed]bool)
+	}
+	ch := make(chan *UpdatedFeed, eventBuffer)
+	b.clients[ch] = true
+	return ch
+}
+
+func (b *eventBroker) unsubscribe(ch chan *UpdatedFeed) {
+	b.Lock()
+	defer b.Unlock()
+	delete(b.clients, ch)
+}
+
+// publish sends update to every client. Clients that have fallen too
+// far behind are dropped, closing their stream so the browser reconnects
+// with Last-Event-ID and catches up from the river.
+func (b *eventBroker) publish(update *UpdatedFeed) {
+	b.Lock()
+	defer b.Unlock()
+
+	for ch, _ := range b.clients {
+		select {
+		case ch <- update:
+		default:
+			close(ch)
+			delete(b.clients, ch)
+		}
+	}
+}
+
+// updateID is the event ID of an update: the ID of its newest item.
+func updateID(update *UpdatedFeed) uint64 {
+	if len(update.Items) == 0 {
+		return 0
+	}
+	id, _ := strconv.ParseUint(update.Items[0].Id, 10, 64)
+	return id
+}
+
+// writeEvent writes update as a single server-sent event.
+func writeEvent(w io.Writer, update *UpdatedFeed) error {
+	data, err := json.Marshal(update)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "id: %d\ndata: %s\n\n", updateID(update), data)
+	return err
+}
+
+// serveEvents streams each new feed update to the client as it's
+// committed. Clients reconnecting with Last-Event-ID are first sent
+// whatever they missed that's still in the river.
+func (r *River) serveEvents(w http.ResponseWriter, req *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	// Subscribe before replaying so nothing slips through in between
+	ch := r.events.subscribe()
+	defer r.events.unsubscribe(ch)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+
+	var lastID uint64
+	if last := req.Header.Get("Last-Event-ID"); last != "" {
+		lastID, _ = strconv.ParseUint(last, 10, 64)
+
+		js := r.newRiverJS()
+		if err := db.View(getRiver(r.Name, &js)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		missed := js.UpdatedFeeds.UpdatedFeed
+		for i := len(missed) - 1; i >= 0; i-- {
+			if id := updateID(missed[i]); id > lastID {
+				if err := writeEvent(w, missed[i]); err != nil {
+					return
+				}
+				lastID = id
+			}
+		}
+	}
+	flusher.Flush()
+
+	keepalive := time.NewTicker(eventKeepalive)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case update, ok := <-ch:
+			if !ok {
+				// Dropped for falling behind
+				return
+			}
+			id := updateID(update)
+			if id <= lastID {
+				continue
+			}
+			if err := writeEvent(w, update); err != nil {
+				return
+			}
+			lastID = id
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(w, ": keepalive\n\n"); err != nil {
+				return
+			}
+		case <-req.Context().Done():
+			return
+		}
+		flusher.Flush()
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestPublishDropsSlowClients(t *testing.T) {
+	var b eventBroker
+	slow, fast := b.subscribe(), b.subscribe()
+
+	for i := 1; i <= eventBuffer+1; i++ {
+		update := &UpdatedFeed{Items: []*UpdatedFeedItem{{Id: strconv.Itoa(i)}}}
+		b.publish(update)
+		<-fast
+	}
+
+	// The queued updates still arrive, then the stream ends so the
+	// client reconnects rather than silently missing one.
+	for i := 1; i <= eventBuffer; i++ {
+		update, ok := <-slow
+		if !ok {
+			t.Fatalf("stream closed after %d update(s), want %d", i-1, eventBuffer)
+		}
+		if id := updateID(update); id != uint64(i) {
+			t.Fatalf("update %d has ID %d", i, id)
+		}
+	}
+	if _, ok := <-slow; ok {
+		t.Error("slow client's stream left open after an update was dropped")
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.clients[slow] || !b.clients[fast] {
+		t.Errorf("clients = %v, want only the fast one", b.clients)
+	}
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"regexp"
+	"strings"
+)
+
+// filterFields are the parts of an item a filter rule can match against.
+var filterFields = []string{"title", "body", "link", "author"}
+
+// filter is a compiled FilterConfig.
+type filter struct {
+	include  bool
+	keywords []string
+	patterns []*regexp.Regexp
+	feeds    map[string]bool
+	fields   []string
+}
+
+// newFilters compiles the river's filter rules, rejecting unknown
+// actions and fields and invalid regexes.
+func newFilters(configs []FilterConfig) ([]*filter, error) {
+	var filters []*filter
+	for i, config := range configs {
+		f := filter{feeds: make(map[string]bool)}
+
+		switch config.Action {
+		case "include":
+			f.include = true
+		case "exclude", "":
+		default:
+			return nil, fmt.Errorf("filter %d: unknown action %q", i+1, config.Action)
+		}
+
+		for _, keyword := range config.Keywords {
+			f.keywords = append(f.keywords, strings.ToLower(keyword))
+		}
+		for _, expr := range config.Regex {
+			re, err := regexp.Compile(expr)
+			if err != nil {
+				return nil, fmt.Errorf("filter %d: %v", i+1, err)
+			}
+			f.patterns = append(f.patterns, re)
+		}
+		for _, feed := range config.Feeds {
+			f.feeds[feed] = true
+		}
+
+		f.fields = config.Fields
+		if len(f.fields) == 0 {
+			f.fields = filterFields
+		}
+		for _, field := range f.fields {
+			if !validField(field) {
+				return nil, fmt.Errorf("filter %d: unknown field %q", i+1, field)
+			}
+		}
+
+		filters = append(filters, &f)
+	}
+	return filters, nil
+}
+
+func validField(field string) bool {
+	for _, valid := range filterFields {
+		if field == valid {
+			return true
+		}
+	}
+	return false
+}
+
+// itemField returns the text of one of the filterFields of item.
+func itemField(item *gofeed.Item, field string) string {
+	switch field {
+	case "title":
+		return makePlainText(item.Title)
+	case "body":
+		return makePlainText(item.Description + " " + item.Content)
+	case "link":
+		return item.Link
+	case "author":
+		var names []string
+		if item.Author != nil {
+			names = append(names, item.Author.Name, item.Author.Email)
+		}
+		for _, author := range item.Authors {
+			names = append(names, author.Name, author.Email)
+		}
+		return strings.Join(names, " ")
+	}
+	return ""
+}
+
+// applies reports whether the filter covers items from feedURL.
+func (f *filter) applies(feedURL string) bool {
+	return len(f.feeds) == 0 || f.feeds[feedURL]
+}
+
+// matches reports whether any keyword (case-insensitively) or regex of
+// the filter is found in any of its fields of item.
+func (f *filter) matches(item *gofeed.Item) bool {
+	for _, field := range f.fields {
+		text := itemField(item, field)
+		lower := strings.ToLower(text)
+		for _, keyword := range f.keywords {
+			if strings.Contains(lower, keyword) {
+				return true
+			}
+		}
+		for _, re := range f.patterns {
+			if re.MatchString(text) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// filtered reports whether the river's filters keep item from feedURL
+// out of the river: it matches an exclude rule, or there are include
+// rules for the feed and it matches none of them.
+func (r *River) filtered(feedURL string, item *gofeed.Item) bool {
+	included, haveIncludes := false, false
+	for _, f := range r.filters {
+		if !f.applies(feedURL) {
+			continue
+		}
+		if f.include {
+			haveIncludes = true
+			included = included || f.matches(item)
+		} else if f.matches(item) {
+			return true
+		}
+	}
+	return haveIncludes && !included
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"time"
+)
+
+// collectGarbage forgets fingerprints of items that haven't been seen in
+// fingerprintDays, dedup keys too old to match, and the stored state of
+// feeds no longer in the river. Run calls it once a day.
+func (r *River) collectGarbage() {
+	cutoff := time.Now().AddDate(0, 0, -r.fingerprintDays)
+
+	// Feeds that haven't returned content since the cutoff keep their
+	// fingerprints, so they don't repeat themselves when they come
+	// back. A 304 doesn't count, since it doesn't mark the feed's items
+	// as seen.
+	feeds := make(map[string]bool)
+	var stalled []string
+	for url, _ := range r.Streams {
+		feeds[url] = true
+
+		status := FeedStatus{URL: url}
+		if err := db.View(getStatus(r.Name, url, &status)); err != nil {
+			errorLog.Printf("couldn't load status for %q (%v)", url, err)
+			continue
+		}
+		if status.LastContent.Before(cutoff) {
+			stalled = append(stalled, r.origins([]string{url})...)
+		}
+	}
+
+	var fingerprints, duplicates, keys int
+	if err := db.Update(collectFingerprints(r.Name, cutoff, stalled, &fingerprints)); err != nil {
+		errorLog.Printf("couldn't collect fingerprints in %s (%v)", r.Name, err)
+	}
+	if err := db.Update(collectDuplicateKeys(r.Name, time.Now().Add(-r.dedupWindow), &duplicates)); err != nil {
+		errorLog.Printf("couldn't collect dedup keys in %s (%v)", r.Name, err)
+	}
+
+	// An OPML river whose OPML couldn't be fetched has no feeds, but
+	// they haven't really been removed
+	if len(feeds) > 0 {
+		if err := db.Update(pruneFeedKeys(r.Name, feeds, &keys)); err != nil {
+			errorLog.Printf("couldn't prune removed feeds in %s (%v)", r.Name, err)
+		}
+	}
+
+	if fingerprints > 0 || duplicates > 0 || keys > 0 {
+		logger.Printf("forgot %d fingerprint(s), %d dedup key(s) and %d key(s) of removed feeds in %s", fingerprints, duplicates, keys, r.Name)
+	}
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/boltdb/bolt"
+	"github.com/mmcdole/gofeed"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCollectGarbageKeepsNotModifiedFeeds(t *testing.T) {
+	const (
+		name    = "gc"
+		quiet   = "http://example.com/quiet"
+		chatty  = "http://example.com/chatty"
+		oldItem = ":http://example.com/old"
+	)
+
+	r := NewRiver(RiverConfig{Name: name, Workers: 1, FingerprintDays: 90}, []string{quiet, chatty}, nil)
+	defer func() {
+		for _, timer := range r.Timers {
+			timer.Stop()
+		}
+	}()
+
+	// Both feeds' items were last seen long ago. The quiet feed has
+	// answered 304 since, while the chatty one keeps returning content
+	// without them.
+	long := time.Now().AddDate(0, 0, -100)
+	err := db.Update(func(tx *bolt.Tx) error {
+		raw, err := json.Marshal(Fingerprint{FirstSeen: long, LastSeen: long})
+		if err != nil {
+			return err
+		}
+		b := tx.Bucket([]byte(name)).Bucket([]byte("fingerprints"))
+		for _, key := range []string{quiet + oldItem, chatty + oldItem} {
+			if err := b.Put([]byte(key), raw); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	r.updateStatus(FetchResult{URL: quiet, StatusCode: http.StatusNotModified}, 0)
+	r.ProcessFeed(FetchResult{URL: chatty, Feed: &gofeed.Feed{Items: []*gofeed.Item{{Title: "New", Link: "http://example.com/new"}}}, StatusCode: http.StatusOK})
+
+	r.collectGarbage()
+
+	tests := []struct {
+		fingerprint string
+		kept        bool
+	}{
+		{quiet + oldItem, true},
+		{chatty + oldItem, false},
+	}
+	for _, test := range tests {
+		var kept bool
+		err := db.View(func(tx *bolt.Tx) error {
+			kept = tx.Bucket([]byte(name)).Bucket([]byte("fingerprints")).Get([]byte(test.fingerprint)) != nil
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if kept != test.kept {
+			t.Errorf("%s: kept = %v, want %v", test.fingerprint, kept, test.kept)
+		}
+	}
+}
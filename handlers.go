@@ -1,12 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"html/template"
+	"io"
 	"net/http"
+	"os"
 	"path"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // RiverJS is the root JSON returned by /river.
@@ -35,12 +43,24 @@ type UpdatedFeedItem struct {
 	Title     string `json:"title"`
 	Link      string `json:"link"`
 	Id        string `json:"id"`
-}
 
-func (r *River) serveRiver(w http.ResponseWriter, req *http.Request) {
-	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	Enclosures []*Enclosure `json:"enclosure,omitempty"`
+	Duration   string       `json:"duration,omitempty"` // iTunes duration
+	Image      string       `json:"image,omitempty"`
+
+	Duplicates []*Duplicate `json:"duplicates,omitempty"`
 
-	js := RiverJS{
+	// Updated is set on items edited after they were first published,
+	// either republished with the ID of the OriginalID, or revised in
+	// place with the earlier Revisions.
+	Updated    bool        `json:"updated,omitempty"`
+	OriginalID string      `json:"originalId,omitempty"`
+	Revisions  []*Revision `json:"revisions,omitempty"`
+}
+
+// newRiverJS returns an empty RiverJS with the river's metadata filled in.
+func (r *River) newRiverJS() RiverJS {
+	return RiverJS{
 		Metadata: map[string]string{
 			"name":             r.Name,
 			"title":            r.Title,
@@ -54,19 +74,133 @@ func (r *River) serveRiver(w http.ResponseWriter, req *http.Request) {
 			"whenStartedLocal": r.whenStartedLocal,
 		},
 	}
+}
 
-	err := db.View(getRiver(r.Name, &js))
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-	}
+// writeRiverJS encodes js wrapped in the JSONP callback.
+func writeRiverJS(w io.Writer, js RiverJS) error {
+	return writeCallback(w, callbackName, js)
+}
 
+// writeCallback encodes js wrapped in callback, or as bare JSON if
+// callback is empty.
+func writeCallback(w io.Writer, callback string, js RiverJS) error {
 	enc := json.NewEncoder(w)
 	enc.SetIndent("  ", "  ")
 	enc.SetEscapeHTML(false)
 
-	fmt.Fprintf(w, "%s(", callbackName)
-	enc.Encode(js)
-	fmt.Fprint(w, ")")
+	if callback == "" {
+		enc.SetIndent("", "  ")
+		return enc.Encode(js)
+	}
+
+	fmt.Fprintf(w, "%s(", callback)
+	if err := enc.Encode(js); err != nil {
+		return err
+	}
+	_, err := fmt.Fprint(w, ")")
+	return err
+}
+
+// validCallback matches JSONP callbacks we're willing to echo back:
+// plain, optionally dotted, JavaScript identifiers.
+var validCallback = regexp.MustCompile(`^[A-Za-z_$][A-Za-z0-9_$]*(\.[A-Za-z_$][A-Za-z0-9_$]*)*$`)
+
+// serveRiver serves the river wrapped in the onGetRiverStream callback,
+// as river.js clients have always expected.
+func (r *River) serveRiver(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", outputTypes["river"])
+	r.setHubLinks(w, "river")
+	r.serveRiverAs(w, req, callbackName)
+}
+
+// serveRiverJSON serves the river as bare JSON that any origin can fetch.
+func (r *River) serveRiverJSON(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", outputTypes["river.json"])
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	r.setHubLinks(w, "river.json")
+	r.serveRiverAs(w, req, "")
+}
+
+// serveRiverJS serves the river wrapped in the ?callback= of the
+// client's choosing, falling back to onGetRiverStream.
+func (r *River) serveRiverJS(w http.ResponseWriter, req *http.Request) {
+	callback := req.URL.Query().Get("callback")
+	if callback == "" {
+		callback = callbackName
+	}
+	if len(callback) > maxCallbackLength || !validCallback.MatchString(callback) {
+		http.Error(w, "invalid callback", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", outputTypes["river.js"])
+	r.setHubLinks(w, "river.js")
+	r.serveRiverAs(w, req, callback)
+}
+
+// serveRiverAs serves the river, or a page of its archive with
+// ?before=<id>, wrapped in callback.
+func (r *River) serveRiverAs(w http.ResponseWriter, req *http.Request, callback string) {
+	// ?before=<id> pages back through the item archive
+	if before := req.URL.Query().Get("before"); before != "" {
+		js := r.newRiverJS()
+		id, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+
+		if err := db.View(getArchive(r.Name, id, maxArchiveItems, &js)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		// Tell the client where the next page starts
+		if updates := js.UpdatedFeeds.UpdatedFeed; len(updates) > 0 {
+			items := updates[len(updates)-1].Items
+			js.Metadata["nextBefore"] = items[len(items)-1].Id
+		}
+
+		writeCallback(w, callback, js)
+		return
+	}
+
+	response, err := r.cachedRiver(callback)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	response.serve(w, req)
+}
+
+// serveArchive serves the items archived on a single day, at
+// /{river}/archive/YYYY/MM/DD.js. Finished days written to the archive
+// directory are served from there.
+func (r *River) serveArchive(w http.ResponseWriter, req *http.Request) {
+	suffix := strings.TrimPrefix(req.URL.Path, "/"+r.Name+"/archive/")
+	day, err := time.Parse(archiveDayFmt, suffix)
+	if err != nil {
+		http.NotFound(w, req)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	if r.archiveDir != "" {
+		fname := r.archivePath(day)
+		if _, err := os.Stat(fname); err == nil {
+			http.ServeFile(w, req, fname)
+			return
+		}
+	}
+
+	js, err := r.dayRiverJS(day)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	writeRiverJS(w, js)
 }
 
 func (r *River) serveIndex(w http.ResponseWriter, req *http.Request) {
@@ -91,7 +225,11 @@ func (r *River) serveFeedsOpml(w http.ResponseWriter, req *http.Request) {
 		Title:   r.Name + " feeds",
 		Docs:    opmlDocs,
 	}
-	for url, _ := range r.Streams {
+	for _, url := range r.feedURLs() {
+		if err := db.View(getRedirect(r.Name, url, &url)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		outline := Outline{Text: url, URL: url, Type: "rss"}
 		opml.Outlines = append(opml.Outlines, outline)
 	}
@@ -105,3 +243,156 @@ func (r *River) serveFeedsOpml(w http.ResponseWriter, req *http.Request) {
 	w.Write([]byte(xml.Header))
 	w.Write(encoded)
 }
+
+// byFailures sorts feed statuses with the most consecutive failures first.
+type byFailures []*FeedStatus
+
+func (s byFailures) Len() int      { return len(s) }
+func (s byFailures) Swap(i, j int) { s[i], s[j] = s[j], s[i] }
+func (s byFailures) Less(i, j int) bool {
+	if s[i].ConsecutiveFailures != s[j].ConsecutiveFailures {
+		return s[i].ConsecutiveFailures > s[j].ConsecutiveFailures
+	}
+	return s[i].URL < s[j].URL
+}
+
+// feedStatuses returns the stored status of every feed in the river.
+func (r *River) feedStatuses() ([]*FeedStatus, error) {
+	var statuses []*FeedStatus
+	r.feedsMu.RLock()
+	for url, _ := range r.Streams {
+		status := FeedStatus{URL: url}
+		if schedule, ok := r.UpdateSchedule[url]; ok {
+			status.PollInterval = schedule.Interval.String()
+			status.NextFetch = schedule.NextFetch
+		}
+		statuses = append(statuses, &status)
+	}
+	r.feedsMu.RUnlock()
+
+	for _, status := range statuses {
+		if err := db.View(getStatus(r.Name, status.URL, status)); err != nil {
+			return nil, err
+		}
+	}
+	sort.Sort(byFailures(statuses))
+	return statuses, nil
+}
+
+func (r *River) serveFeeds(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+
+	statuses, err := r.feedStatuses()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	fname := path.Join("templates", "feeds.html")
+	tmpl, err := template.ParseFiles(fname)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	data := struct {
+		River *River
+		Feeds []*FeedStatus
+	}{r, statuses}
+
+	if err := tmpl.Execute(w, data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func (r *River) serveFeedsJSON(w http.ResponseWriter, req *http.Request) {
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+	statuses, err := r.feedStatuses()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(statuses)
+}
+
+// outputTypes are the river's feed-style outputs, which can also be
+// subscribed to through the hub, and their content types.
+var outputTypes = map[string]string{
+	"river":      "application/json; charset=utf-8",
+	"river.json": "application/json; charset=utf-8",
+	"river.js":   "application/javascript; charset=utf-8",
+	"rss.xml":    "application/rss+xml; charset=utf-8",
+	"atom.xml":   "application/atom+xml; charset=utf-8",
+	"feed.json":  "application/feed+json; charset=utf-8",
+}
+
+// renderOutput encodes one of the outputTypes. req may be nil when
+// rendering for the hub, in which case URLs are built from the base URL.
+func (r *River) renderOutput(output string, req *http.Request) ([]byte, error) {
+	var v interface{}
+	var err error
+
+	switch output {
+	case "river", "river.js", "river.json":
+		callback := callbackName
+		if output == "river.json" {
+			callback = ""
+		}
+		response, err := r.cachedRiver(callback)
+		if err != nil {
+			return nil, err
+		}
+		return response.body, nil
+	case "rss.xml":
+		v, err = r.rssFeed(req)
+	case "atom.xml":
+		v, err = r.atomFeed(req)
+	case "feed.json":
+		v, err = r.jsonFeed(req)
+	default:
+		return nil, fmt.Errorf("unknown output %q", output)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var buf bytes.Buffer
+	if strings.HasSuffix(output, ".xml") {
+		encoded, err := xml.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		buf.WriteString(xml.Header)
+		buf.Write(encoded)
+	} else {
+		enc := json.NewEncoder(&buf)
+		enc.SetIndent("", "  ")
+		enc.SetEscapeHTML(false)
+		if err := enc.Encode(v); err != nil {
+			return nil, err
+		}
+	}
+	return buf.Bytes(), nil
+}
+
+// serveOutput returns the handler for rss.xml, atom.xml and feed.json.
+func (r *River) serveOutput(output string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		body, err := r.renderOutput(output, req)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", outputTypes[output])
+		if output == "feed.json" {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		}
+		r.setHubLinks(w, output)
+		w.Write(body)
+	}
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// hubBucket holds the hub's subscribers. The leading underscore keeps it
+// clear of river buckets.
+const hubBucket = "_hub"
+
+// Hub lets other aggregators subscribe to our rivers' outputs over
+// WebSub, and pushes them fresh content as rivers update.
+type Hub struct {
+	baseURL    string
+	rivers     map[string]*River
+	httpClient *http.Client
+}
+
+// HubSubscriber is a verified subscription to one of our topics.
+type HubSubscriber struct {
+	Topic    string    `json:"topic"`
+	Callback string    `json:"callback"`
+	Secret   string    `json:"secret,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+// key sorts subscribers by topic, so a river's are found by prefix.
+func (s *HubSubscriber) key() []byte {
+	return []byte(s.Topic + " " + s.Callback)
+}
+
+func NewHub(baseURL string, rivers map[string]*River) *Hub {
+	if err := db.Update(createHubBucket); err != nil {
+		errorLog.Printf("couldn't create hub bucket (%v)", err)
+	}
+
+	return &Hub{
+		baseURL: baseURL,
+		rivers:  rivers,
+		httpClient: &http.Client{
+			Timeout: 10 * time.Second,
+		},
+	}
+}
+
+// topicURL is the hub topic for one of a river's outputs.
+func (h *Hub) topicURL(river *River, output string) string {
+	return h.baseURL + "/" + river.Name + "/" + output
+}
+
+// lookup resolves a topic URL to the river and output it names.
+func (h *Hub) lookup(topic string) (*River, string, bool) {
+	if !strings.HasPrefix(topic, h.baseURL+"/") {
+		return nil, "", false
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(topic, h.baseURL+"/"), "/", 2)
+	if len(parts) != 2 {
+		return nil, "", false
+	}
+
+	river, ok := h.rivers[parts[0]]
+	if _, known := outputTypes[parts[1]]; !ok || !known {
+		return nil, "", false
+	}
+	return river, parts[1], true
+}
+
+// setHubLinks advertises the hub and the output's topic in Link headers.
+func (r *River) setHubLinks(w http.ResponseWriter, output string) {
+	if r.hub == nil {
+		return
+	}
+	w.Header().Add("Link", fmt.Sprintf(`<%s/hub>; rel="hub"`, r.hub.baseURL))
+	w.Header().Add("Link", fmt.Sprintf(`<%s>; rel="self"`, r.hub.topicURL(r, output)))
+}
+
+// ServeHTTP accepts subscription and unsubscription requests, and
+// verifies them with the subscriber in the background.
+func (h *Hub) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	mode := req.PostFormValue("hub.mode")
+	if mode != "subscribe" && mode != "unsubscribe" {
+		http.Error(w, "invalid hub.mode", http.StatusBadRequest)
+		return
+	}
+
+	topic := req.PostFormValue("hub.topic")
+	if _, _, ok := h.lookup(topic); !ok {
+		http.Error(w, "unknown hub.topic", http.StatusBadRequest)
+		return
+	}
+
+	callback, err := url.Parse(req.PostFormValue("hub.callback"))
+	if err != nil || (callback.Scheme != "http" && callback.Scheme != "https") {
+		http.Error(w, "invalid hub.callback", http.StatusBadRequest)
+		return
+	}
+
+	lease := hubLease(req.PostFormValue("hub.lease_seconds"))
+
+	sub := HubSubscriber{
+		Topic:    topic,
+		Callback: callback.String(),
+		Secret:   req.PostFormValue("hub.secret"),
+		Expires:  time.Now().Add(time.Duration(lease) * time.Second),
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	go h.verify(mode, &sub, lease)
+}
+
+// hubLease is the lease in seconds granted for a requested one, which
+// may be missing. Longer leases are cut to hubMaxLease.
+func hubLease(requested string) int {
+	lease, err := strconv.Atoi(requested)
+	switch {
+	case err != nil || lease <= 0:
+		return int(websubLease.Seconds())
+	case time.Duration(lease)*time.Second > hubMaxLease:
+		return int(hubMaxLease.Seconds())
+	}
+	return lease
+}
+
+// verify confirms the subscriber really asked for mode before acting on it.
+func (h *Hub) verify(mode string, sub *HubSubscriber, lease int) {
+	// The challenge must be unguessable, or anyone could confirm an
+	// intent on the subscriber's behalf
+	raw := make([]byte, 20)
+	if _, err := rand.Read(raw); err != nil {
+		errorLog.Printf("couldn't generate challenge for %q (%v)", sub.Callback, err)
+		return
+	}
+	challenge := hex.EncodeToString(raw)
+
+	callback, _ := url.Parse(sub.Callback)
+	query := callback.Query()
+	query.Set("hub.mode", mode)
+	query.Set("hub.topic", sub.Topic)
+	query.Set("hub.challenge", challenge)
+	if mode == "subscribe" {
+		query.Set("hub.lease_seconds", strconv.Itoa(lease))
+	}
+	callback.RawQuery = query.Encode()
+
+	resp, err := h.httpClient.Get(callback.String())
+	if err != nil {
+		errorLog.Printf("couldn't verify %s of %q to %q (%v)", mode, sub.Callback, sub.Topic, err)
+		return
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil || resp.StatusCode < 200 || resp.StatusCode > 299 || string(body) != challenge {
+		logger.Printf("%q didn't confirm %s to %q", sub.Callback, mode, sub.Topic)
+		return
+	}
+
+	if mode == "subscribe" {
+		err = db.Update(setHubSubscriber(sub))
+	} else {
+		err = db.Update(deleteHubSubscriber(sub))
+	}
+	if err != nil {
+		errorLog.Printf("couldn't store %s of %q to %q (%v)", mode, sub.Callback, sub.Topic, err)
+		return
+	}
+	logger.Printf("verified %s of %q to %q", mode, sub.Callback, sub.Topic)
+}
+
+// publish pushes the river's fresh outputs to everyone subscribed to
+// them, dropping subscriptions that have expired.
+func (h *Hub) publish(river *River) {
+	var subs []*HubSubscriber
+	if err := db.View(getHubSubscribers(h.baseURL+"/"+river.Name+"/", &subs)); err != nil {
+		errorLog.Printf("couldn't load hub subscribers for %s (%v)", river.Name, err)
+		return
+	}
+
+	rendered := make(map[string][]byte)
+	for _, sub := range subs {
+		if time.Now().After(sub.Expires) {
+			if err := db.Update(deleteHubSubscriber(sub)); err != nil {
+				errorLog.Printf("couldn't expire hub subscriber %q (%v)", sub.Callback, err)
+			}
+			continue
+		}
+
+		_, output, ok := h.lookup(sub.Topic)
+		if !ok {
+			continue
+		}
+
+		body, ok := rendered[output]
+		if !ok {
+			var err error
+			if body, err = river.renderOutput(output, nil); err != nil {
+				errorLog.Printf("couldn't render %q for hub (%v)", sub.Topic, err)
+				continue
+			}
+			rendered[output] = body
+		}
+
+		if err := h.push(sub, output, body); err != nil {
+			errorLog.Printf("couldn't push %q to %q (%v)", sub.Topic, sub.Callback, err)
+		}
+	}
+}
+
+// push delivers content to a single subscriber, signed with its secret.
+func (h *Hub) push(sub *HubSubscriber, output string, body []byte) error {
+	req, err := http.NewRequest("POST", sub.Callback, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", outputTypes[output])
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Add("Link", fmt.Sprintf(`<%s/hub>; rel="hub"`, h.baseURL))
+	req.Header.Add("Link", fmt.Sprintf(`<%s>; rel="self"`, sub.Topic))
+	if sub.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(sub.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Hub-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := h.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode == http.StatusGone {
+		return db.Update(deleteHubSubscriber(sub))
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return nil
+}
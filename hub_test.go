@@ -0,0 +1,28 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+)
+
+func TestHubLease(t *testing.T) {
+	tests := []struct {
+		requested string
+		want      int
+	}{
+		{"", int(websubLease.Seconds())},
+		{"soon", int(websubLease.Seconds())},
+		{"0", int(websubLease.Seconds())},
+		{"-60", int(websubLease.Seconds())},
+		{"3600", 3600},
+		{strconv.Itoa(int(hubMaxLease.Seconds())), int(hubMaxLease.Seconds())},
+		{strconv.Itoa(int(hubMaxLease.Seconds()) + 1), int(hubMaxLease.Seconds())},
+		{"999999999", int(hubMaxLease.Seconds())},
+	}
+
+	for _, test := range tests {
+		if got := hubLease(test.requested); got != test.want {
+			t.Errorf("hubLease(%q) = %d, want %d", test.requested, got, test.want)
+		}
+	}
+}
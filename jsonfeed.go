@@ -0,0 +1,100 @@
+package main
+
+import "net/http"
+
+const (
+	jsonFeedVersion = "https://jsonfeed.org/version/1.1"
+	sourceAbout     = "https://github.com/edavis/colorado"
+)
+
+type JSONFeed struct {
+	Version     string         `json:"version"`
+	Title       string         `json:"title"`
+	HomePageURL string         `json:"home_page_url,omitempty"`
+	FeedURL     string         `json:"feed_url,omitempty"`
+	Description string         `json:"description,omitempty"`
+	Items       []JSONFeedItem `json:"items"`
+}
+
+type JSONFeedItem struct {
+	ID            string               `json:"id"`
+	URL           string               `json:"url,omitempty"`
+	ExternalURL   string               `json:"external_url,omitempty"`
+	Title         string               `json:"title,omitempty"`
+	ContentHTML   string               `json:"content_html"`
+	DatePublished string               `json:"date_published,omitempty"`
+	DateModified  string               `json:"date_modified,omitempty"`
+	Image         string               `json:"image,omitempty"`
+	Attachments   []JSONFeedAttachment `json:"attachments,omitempty"`
+	Source        JSONFeedSource       `json:"_source"`
+}
+
+// JSONFeedAttachment is an item's enclosure.
+type JSONFeedAttachment struct {
+	URL               string `json:"url"`
+	MIMEType          string `json:"mime_type"`
+	SizeInBytes       int64  `json:"size_in_bytes,omitempty"`
+	DurationInSeconds int    `json:"duration_in_seconds,omitempty"`
+}
+
+// JSONFeedSource is our extension describing the feed an item came from.
+type JSONFeedSource struct {
+	About       string `json:"about"`
+	FeedURL     string `json:"feed_url"`
+	HomePageURL string `json:"home_page_url,omitempty"`
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// jsonFeed builds the JSON Feed version of the river.
+func (r *River) jsonFeed(req *http.Request) (*JSONFeed, error) {
+	updates, err := r.outputItems()
+	if err != nil {
+		return nil, err
+	}
+
+	feed := JSONFeed{
+		Version:     jsonFeedVersion,
+		Title:       r.Title,
+		HomePageURL: r.absURL(req, "/"+r.Name+"/"),
+		FeedURL:     r.absURL(req, "/"+r.Name+"/feed.json"),
+		Description: r.Description,
+		Items:       []JSONFeedItem{},
+	}
+	if feed.Title == "" {
+		feed.Title = r.Name
+	}
+
+	for _, update := range updates {
+		for _, item := range update.Items {
+			jsonItem := JSONFeedItem{
+				ID:            r.itemGUID(outputID(item)),
+				URL:           item.Link,
+				ExternalURL:   item.PermaLink,
+				Title:         item.Title,
+				ContentHTML:   item.Body,
+				DatePublished: rfc3339Date(item.PubDate),
+				DateModified:  rfc3339Date(whenEdited(update, item)),
+				Image:         item.Image,
+				Source: JSONFeedSource{
+					About:       sourceAbout,
+					FeedURL:     update.URL,
+					HomePageURL: update.Website,
+					Title:       update.Title,
+					Description: update.Description,
+				},
+			}
+			for _, enclosure := range item.Enclosures {
+				jsonItem.Attachments = append(jsonItem.Attachments, JSONFeedAttachment{
+					URL:               enclosure.URL,
+					MIMEType:          enclosure.mimeType(),
+					SizeInBytes:       enclosure.Length,
+					DurationInSeconds: durationSeconds(item.Duration),
+				})
+			}
+			feed.Items = append(feed.Items, jsonItem)
+		}
+	}
+
+	return &feed, nil
+}
@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/url"
+	"sync"
+)
+
+// fetchLimiter bounds concurrent fetches across every river in the
+// container, and against any single host.
+type fetchLimiter struct {
+	slots     chan struct{}
+	hostLimit int
+
+	mu    sync.Mutex
+	hosts map[string]chan struct{}
+}
+
+func newFetchLimiter(maxWorkers, hostLimit int) *fetchLimiter {
+	return &fetchLimiter{
+		slots:     make(chan struct{}, maxWorkers),
+		hostLimit: hostLimit,
+		hosts:     make(map[string]chan struct{}),
+	}
+}
+
+// acquire blocks until both a host slot and a global slot are free for
+// feedURL. The returned func gives them back.
+func (l *fetchLimiter) acquire(feedURL string) func() {
+	host := l.host(feedURL)
+	host <- struct{}{}
+	l.slots <- struct{}{}
+
+	return func() {
+		<-l.slots
+		<-host
+	}
+}
+
+// host returns the semaphore for the host of feedURL, creating it if needed.
+func (l *fetchLimiter) host(feedURL string) chan struct{} {
+	name := feedURL
+	if u, err := url.Parse(feedURL); err == nil && u.Host != "" {
+		name = u.Host
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	sem, ok := l.hosts[name]
+	if !ok {
+		sem = make(chan struct{}, l.hostLimit)
+		l.hosts[name] = sem
+	}
+	return sem
+}
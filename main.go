@@ -12,17 +12,19 @@ import (
 
 var (
 	logger, errorLog   *log.Logger
-	db                 *bolt.DB
+	db, searchDB       *bolt.DB
 	dbPath, configPath string
+	searchPath         string
 	quickStart         bool
 	watcher            *fsnotify.Watcher
 )
 
 // Set up two loggers: logger for os.Stdout, and errorLog for error.log
-func init() {
+func setup() {
 	flag.StringVar(&dbPath, "database", "feeds.db", "path to BoltDB database")
+	flag.StringVar(&searchPath, "search", "search.db", "path to BoltDB full-text search index")
 	flag.StringVar(&configPath, "config", "config.toml", "path to TOML config")
-	flag.BoolVar(&quickStart, "quick", false, "don't do an initial feed update")
+	flag.BoolVar(&quickStart, "quick", false, "spread the initial feed update over the poll interval")
 	flag.Parse()
 
 	logger = log.New(os.Stdout, "", log.LstdFlags|log.Lmicroseconds)
@@ -38,21 +40,28 @@ func init() {
 		logger.Fatalln(err)
 	}
 
+	searchDB, err = bolt.Open(searchPath, 0644, nil)
+	if err != nil {
+		logger.Fatalln(err)
+	}
+
 	watcher, err = fsnotify.NewWatcher()
 	if err != nil {
 		logger.Fatalln(err)
 	}
 }
 
-// cleanup closes the bolt database.
+// cleanup closes the bolt databases.
 func cleanup() {
 	if err := watcher.Close(); err != nil {
 		logger.Printf("problem closing watcher: %v", err)
 	}
 	db.Close()
+	searchDB.Close()
 }
 
 func main() {
+	setup()
 	logger.Println("starting up")
 
 	config, err := loadConfig(configPath)
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"github.com/mmcdole/gofeed"
-	"github.com/satori/go.uuid"
+	"github.com/mmcdole/gofeed/rss"
+	"io/ioutil"
 	"net/http"
+	"strconv"
+	"sync"
 	"time"
 )
 
@@ -16,29 +20,108 @@ type River struct {
 	FetchResults     chan FetchResult
 	Updater          chan string
 	Streams          map[string]bool
-	UpdateSchedule   map[string]time.Duration
+	UpdateSchedule   map[string]*FeedSchedule
 	Timers           map[string]*time.Timer
+	feedsMu          sync.RWMutex  // guards Streams and UpdateSchedule, which handlers read
+	feedChanges      chan []string // the feeds in the reloaded config
+	workers          int
+	limiter          *fetchLimiter
+	rewriteRedirects bool
+	archiveDir       string
+	fingerprintDays  int
+	baseURL          string // public URL colorado is served from, if known
+	hub              *Hub   // nil unless baseURL is set
+	cache            riverCache
+	events           eventBroker
+	webhooks         []WebhookConfig
+	filters          []*filter
+	dedup            string
+	dedupWindow      time.Duration
+	edits            string
+	webhookWake      chan bool
 	httpClient       *http.Client
 	whenStartedGMT   string // Track startup times
 	whenStartedLocal string
 }
 
-// FetchResult holds the URL of the feed and its parsed representation.
+// FeedSchedule tracks a feed's poll interval and when it was last and
+// will next be fetched. It is persisted so restarts resume the schedule.
+type FeedSchedule struct {
+	Interval  time.Duration `json:"interval"`
+	LastFetch time.Time     `json:"lastFetch"`
+	NextFetch time.Time     `json:"nextFetch"`
+	Failures  int           `json:"failures"`
+	Gone      int           `json:"gone"` // consecutive 404s and 410s
+	Parked    bool          `json:"parked"`
+}
+
+// FeedStatus is the health of a single feed, as shown on /{river}/feeds.
+type FeedStatus struct {
+	URL                 string    `json:"url"`
+	LastSuccess         time.Time `json:"lastSuccess"`
+	LastContent         time.Time `json:"lastContent"` // last success that wasn't a 304
+	LastError           string    `json:"lastError"`
+	LastErrorTime       time.Time `json:"lastErrorTime"`
+	ConsecutiveFailures int       `json:"consecutiveFailures"`
+	LastStatus          int       `json:"lastStatus"`
+	ItemCount           int       `json:"itemCount"`
+	PollInterval        string    `json:"pollInterval"`
+	NextFetch           time.Time `json:"nextFetch"`
+	Parked              bool      `json:"parked"`
+	MovedTo             string    `json:"movedTo,omitempty"`
+	Hub                 string    `json:"hub,omitempty"`
+	LastFiltered        int       `json:"lastFiltered"`
+	Filtered            int       `json:"filtered"`
+}
+
+// Fingerprint records when an item was first and last seen in its feed,
+// the hash of its content when last seen, and the ID it was published
+// under.
+type Fingerprint struct {
+	FirstSeen time.Time `json:"firstSeen"`
+	LastSeen  time.Time `json:"lastSeen"`
+	Hash      string    `json:"hash,omitempty"`
+	ID        string    `json:"id,omitempty"`
+}
+
+// FetchResult holds the URL of the feed and its parsed representation,
+// or the error that kept it from being fetched. MovedTo is set when the
+// feed has newly been permanently redirected, Hub when the feed
+// advertises a WebSub hub for Topic, and Cloud when it has an rssCloud.
 type FetchResult struct {
-	URL  string
-	Feed *gofeed.Feed
+	URL        string
+	Feed       *gofeed.Feed
+	StatusCode int
+	RetryAfter time.Duration
+	MovedTo    string
+	Hub        string
+	Topic      string
+	Cloud      *rss.Cloud
+	Err        error
 }
 
-func NewRiver(name, title, description string, feeds []string) *River {
+func NewRiver(config RiverConfig, feeds []string, limiter *fetchLimiter) *River {
+	name := config.Name
 	r := River{
 		Name:             name,
-		Title:            title,
-		Description:      description,
-		FetchResults:     make(chan FetchResult),
-		Updater:          make(chan string),
+		Title:            config.Title,
+		Description:      config.Description,
+		FetchResults:     make(chan FetchResult, config.Workers),
+		Updater:          make(chan string, len(feeds)),
 		Streams:          make(map[string]bool),
-		UpdateSchedule:   make(map[string]time.Duration),
+		UpdateSchedule:   make(map[string]*FeedSchedule),
 		Timers:           make(map[string]*time.Timer),
+		feedChanges:      make(chan []string),
+		workers:          config.Workers,
+		limiter:          limiter,
+		rewriteRedirects: config.RewriteRedirects,
+		archiveDir:       config.ArchiveDir,
+		fingerprintDays:  config.FingerprintDays,
+		webhooks:         config.Webhook,
+		dedup:            config.Dedup,
+		dedupWindow:      time.Duration(config.DedupHours) * time.Hour,
+		edits:            config.Edits,
+		webhookWake:      make(chan bool, 1),
 		whenStartedGMT:   nowGMT(),
 		whenStartedLocal: nowLocal(),
 		httpClient: &http.Client{
@@ -46,32 +129,184 @@ func NewRiver(name, title, description string, feeds []string) *River {
 		},
 	}
 
+	if err := db.Update(createBucket(name)); err != nil {
+		errorLog.Printf("couldn't create bucket %s (%v)", name, err)
+		logger.Printf("couldn't create bucket %s (%v)", name, err)
+	}
+
+	if err := db.Update(migrateRiver(name)); err != nil {
+		errorLog.Printf("couldn't migrate river %s to the updates bucket (%v)", name, err)
+	}
+
+	var created bool
+	if err := searchDB.Update(createIndexBucket(name, &created)); err != nil {
+		errorLog.Printf("couldn't create search index for %s (%v)", name, err)
+	} else if created {
+		r.reindex()
+	}
+
+	if err := db.Update(migrateFingerprints(name, r.origins(feeds))); err != nil {
+		errorLog.Printf("couldn't migrate random fingerprints in river %s (%v)", name, err)
+	}
+
+	if err := db.Update(migrateFingerprintBucket(name)); err != nil {
+		errorLog.Printf("couldn't move fingerprints in river %s to their bucket (%v)", name, err)
+	}
+
+	// loadConfig has already rejected invalid filters
+	filters, err := newFilters(config.Filter)
+	if err != nil {
+		errorLog.Printf("couldn't compile filters for %s (%v)", name, err)
+	}
+	r.filters = filters
+
 	for _, feed := range feeds {
 		r.Streams[feed] = true
-		r.UpdateSchedule[feed] = pollDefault
+		r.UpdateSchedule[feed] = r.loadSchedule(feed)
 	}
 
-	if err := db.Update(createBucket(name)); err != nil {
-		errorLog.Printf("couldn't create bucket %s (%v)", name, err)
-		logger.Println("couldn't create bucket %s (%v)", name, err)
+	return &r
+}
+
+// hasFeed reports whether url is one of the river's feeds. Like
+// feedURLs and FeedCount, it's safe to call from HTTP handlers.
+func (r *River) hasFeed(url string) bool {
+	r.feedsMu.RLock()
+	defer r.feedsMu.RUnlock()
+	return r.Streams[url]
+}
+
+// feedURLs returns the river's feeds.
+func (r *River) feedURLs() []string {
+	r.feedsMu.RLock()
+	defer r.feedsMu.RUnlock()
+
+	var feeds []string
+	for url, _ := range r.Streams {
+		feeds = append(feeds, url)
 	}
+	return feeds
+}
 
-	return &r
+// FeedCount returns how many feeds the river has.
+func (r *River) FeedCount() int {
+	r.feedsMu.RLock()
+	defer r.feedsMu.RUnlock()
+	return len(r.Streams)
 }
 
-func (r *River) Run() {
-	go r.FetchWorker()
+// origins returns the URLs the fingerprints of feeds are keyed on.
+func (r *River) origins(feeds []string) []string {
+	var origins []string
+	for _, feed := range feeds {
+		origin := feed
+		if err := db.View(getOrigin(r.Name, feed, &origin)); err != nil {
+			errorLog.Printf("couldn't look up origin for %q (%v)", feed, err)
+		}
+		origins = append(origins, origin)
+	}
+	return origins
+}
 
-	if !quickStart {
-		go func() {
-			for url, _ := range r.Streams {
-				r.Updater <- url
-			}
-		}()
+// loadSchedule returns the stored schedule for url, or a fresh one
+// polling at pollDefault if it has never been fetched.
+func (r *River) loadSchedule(url string) *FeedSchedule {
+	schedule := FeedSchedule{Interval: pollDefault}
+	if err := db.View(getSchedule(r.Name, url, &schedule)); err != nil {
+		errorLog.Printf("couldn't load schedule for %q (%v)", url, err)
 	}
+	return &schedule
+}
+
+func (r *River) Run() {
+	for i := 0; i < r.workers; i++ {
+		go r.FetchWorker()
+	}
+	go r.ArchiveWorker()
+	go r.WebhookWorker()
+
+	// Feeds not yet due pick up where they left off. The rest are
+	// fetched right away, or with -quick spread out over their poll
+	// interval so they don't all land at once.
+	var due []string
+	for url, _ := range r.Streams {
+		schedule := r.UpdateSchedule[url]
+		wait := time.Until(schedule.NextFetch)
+		switch {
+		case schedule.Parked:
+			logger.Printf("skipping parked feed %q in %s", url, r.Name)
+		case wait > 0:
+			r.schedule(url, wait)
+		case quickStart:
+			r.schedule(url, jitter(schedule.Interval))
+		default:
+			due = append(due, url)
+		}
+	}
+
+	go func() {
+		for _, url := range due {
+			r.Updater <- url
+		}
+	}()
+
+	// Garbage collection reads the feed maps too, so it runs here
+	// rather than on its own goroutine.
+	r.collectGarbage()
+	gc := time.NewTicker(gcInterval)
 
 	for {
-		r.ProcessFeed(<-r.FetchResults)
+		select {
+		case result := <-r.FetchResults:
+			r.ProcessFeed(result)
+		case feeds := <-r.feedChanges:
+			r.updateFeeds(feeds)
+		case <-gc.C:
+			r.collectGarbage()
+		}
+	}
+}
+
+// updateFeeds adds and removes feeds to match the reloaded config.
+func (r *River) updateFeeds(feeds []string) {
+	newFeeds := make(map[string]bool)
+
+	// Add any new feeds to r.Streams
+	for _, feed := range feeds {
+		newFeeds[feed] = true
+
+		if _, ok := r.Streams[feed]; !ok {
+			logger.Printf("adding %q to %s river", feed, r.Name)
+			schedule := r.loadSchedule(feed)
+			r.feedsMu.Lock()
+			r.Streams[feed] = true
+			r.UpdateSchedule[feed] = schedule
+			r.feedsMu.Unlock()
+			r.schedule(feed, 0)
+		}
+	}
+
+	// Remove any feeds in r.Streams that are no longer in the config file
+	for _, feed := range r.feedURLs() {
+		if _, ok := newFeeds[feed]; !ok {
+			logger.Printf("removing %q from %s river", feed, r.Name)
+			if timer, ok := r.Timers[feed]; ok {
+				if stopped := timer.Stop(); !stopped {
+					logger.Printf("problem stopping timer for %q", feed)
+				}
+			}
+			delete(r.Timers, feed)
+			r.feedsMu.Lock()
+			delete(r.Streams, feed)
+			delete(r.UpdateSchedule, feed)
+			r.feedsMu.Unlock()
+
+			// Forget its schedule, status and cache headers so a
+			// parked feed that's re-added later starts afresh.
+			if err := db.Update(deleteFeedKeys(r.Name, feed)); err != nil {
+				errorLog.Printf("couldn't delete stored state for %q (%v)", feed, err)
+			}
+		}
 	}
 }
 
@@ -82,9 +317,20 @@ func (r *River) FetchWorker() {
 }
 
 func (r *River) Fetch(url string) {
-	req, err := http.NewRequest("GET", url, nil)
+	release := r.limiter.acquire(url)
+	defer release()
+
+	// Feeds that have permanently moved are fetched from their new home,
+	// but keep their original URL everywhere else.
+	target := url
+	if err := db.View(getRedirect(r.Name, url, &target)); err != nil {
+		errorLog.Printf("couldn't look up redirect for %q (%v)", url, err)
+	}
+
+	req, err := http.NewRequest("GET", target, nil)
 	if err != nil {
 		errorLog.Printf("error creating request for %q (%v)", url, err)
+		r.FetchResults <- FetchResult{URL: url, Err: err}
 		return
 	}
 
@@ -99,22 +345,49 @@ func (r *River) Fetch(url string) {
 	resp, err := r.httpClient.Do(req)
 	if err != nil {
 		errorLog.Printf("error requesting %q (%v)", url, err)
+		r.FetchResults <- FetchResult{URL: url, Err: err}
 		return
 	}
 	defer resp.Body.Close()
 
+	var movedTo string
+	if moved := permanentRedirect(resp); moved != "" && moved != target {
+		movedTo = moved
+	}
+
 	if resp.StatusCode == http.StatusNotModified {
-		r.FetchResults <- FetchResult{URL: url, Feed: nil}
+		r.FetchResults <- FetchResult{URL: url, Feed: nil, StatusCode: resp.StatusCode, MovedTo: movedTo}
+		return
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		err := fmt.Errorf("unexpected status %q", resp.Status)
+		errorLog.Printf("error requesting %q (%v)", url, err)
+		result := FetchResult{URL: url, StatusCode: resp.StatusCode, Err: err}
+		if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+			result.RetryAfter = parseRetryAfter(resp.Header.Get("Retry-After"))
+		}
+		r.FetchResults <- result
+		return
+	}
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		errorLog.Printf("error reading %q (%v)", url, err)
+		r.FetchResults <- FetchResult{URL: url, StatusCode: resp.StatusCode, Err: err}
 		return
 	}
 
 	parser := gofeed.NewParser()
-	feed, err := parser.Parse(resp.Body)
+	feed, err := parser.Parse(bytes.NewReader(body))
 	if err != nil {
 		errorLog.Printf("error parsing %q (%v)", url, err)
+		r.FetchResults <- FetchResult{URL: url, StatusCode: resp.StatusCode, Err: err}
 		return
 	}
 
+	hub, topic := discoverHub(resp, body, feed)
+
 	// If made it this far, the fetch was a success. Update the cache
 	// headers and send a FetchResult to the FetchResults channel.
 	err = db.Batch(setCacheHeaders(r.Name, url, resp))
@@ -122,34 +395,64 @@ func (r *River) Fetch(url string) {
 		errorLog.Printf("couldn't update cache headers for %q (%v)", url, err)
 	}
 
-	r.FetchResults <- FetchResult{URL: url, Feed: feed}
+	r.FetchResults <- FetchResult{
+		URL:        url,
+		Feed:       feed,
+		StatusCode: resp.StatusCode,
+		MovedTo:    movedTo,
+		Hub:        hub,
+		Topic:      topic,
+		Cloud:      discoverCloud(body, feed),
+	}
 }
 
 func (r *River) ProcessFeed(result FetchResult) {
 	feed := result.Feed
 	feedUrl := result.URL
-	newItems := 0
+	newItems, filtered, duplicates, edited := 0, 0, 0, 0
+
+	// The feed may have been dropped from the config while it was
+	// being fetched.
+	if _, ok := r.Streams[feedUrl]; !ok {
+		return
+	}
+
+	if result.Err != nil {
+		nextPoll := r.backoff(result)
+		r.updateStatus(result, 0)
+		if schedule, ok := r.UpdateSchedule[feedUrl]; ok && schedule.Parked {
+			logger.Printf("parked %q in %s after %d failures (%v)", feedUrl, r.Name, maxPermanentFailures, result.Err)
+		} else {
+			logger.Printf("couldn't fetch %q for %s (%v, next update = %v)", feedUrl, r.Name, result.Err, nextPoll)
+		}
+		return
+	}
+
+	if result.MovedTo != "" {
+		r.recordRedirect(feedUrl, result.MovedTo)
+	}
+
+	if result.Hub != "" {
+		r.ensureSubscription(feedUrl, result.Hub, result.Topic)
+	}
+
+	if result.Cloud != nil {
+		r.ensureCloud(feedUrl, result.Cloud)
+	}
 
 	// feed is nil if Fetch received HTTP 304
 	if feed == nil {
 		nextPoll := r.updatePollInterval(feedUrl, newItems)
+		r.updateStatus(result, 0)
 		logger.Printf("added 0 new item(s) from %q to %s (HTTP 304, next update = %v)", feedUrl, r.Name, nextPoll)
 		return
 	}
 
-	generateFingerprint := func(url string, item *gofeed.Item) string {
-		var guid string
-
-		switch {
-		case item.GUID != "":
-			guid = item.GUID
-		case item.Link != "":
-			guid = item.Link
-		default:
-			guid = uuid.NewV4().String()
-		}
-
-		return fmt.Sprintf("%s:%s", url, guid)
+	// Fingerprints stay keyed on the URL the feed was first subscribed
+	// at, so a feed rewritten to its new URL doesn't repeat itself.
+	origin := feedUrl
+	if err := db.View(getOrigin(r.Name, feedUrl, &origin)); err != nil {
+		errorLog.Printf("couldn't look up origin for %q (%v)", feedUrl, err)
 	}
 
 	extractBody := func(item *gofeed.Item) string {
@@ -171,37 +474,131 @@ func (r *River) ProcessFeed(result FetchResult) {
 		LastUpdate:  nowGMT(),
 	}
 
+	// Items without a GUID or link used to get random fingerprints. The
+	// first fetch after migrating them records every item it hasn't
+	// seen without publishing it, since an item whose GUID happened to
+	// look random lost its fingerprint too.
+	var reseed bool
+	if err := db.View(getReseed(r.Name, origin, &reseed)); err != nil {
+		errorLog.Printf("couldn't check whether %q needs reseeding (%v)", feedUrl, err)
+	}
+
 	// Loop through items in reverse so most recent gets higher ID
 	for i := len(feed.Items) - 1; i >= 0; i-- {
 		item := feed.Items[i]
-		fingerprint := generateFingerprint(feedUrl, item)
+		fingerprint := generateFingerprint(origin, item)
+
+		var (
+			seen     bool
+			previous Fingerprint
+		)
+		hash := revisionHash(item)
+		if err := db.Batch(checkFingerprint(r.Name, fingerprint, hash, &seen, &previous)); err != nil {
+			errorLog.Printf("couldn't check if fingerprint has been seen before (%v)", err)
+		}
+
+		// Fingerprints from before content hashes were kept have none
+		// to compare against.
+		changed := seen && previous.Hash != "" && previous.Hash != hash
+		if (seen && (!changed || r.edits == "")) || (reseed && !seen) {
+			continue
+		}
 
-		var seen bool
-		if err := db.Batch(checkFingerprint(r.Name, fingerprint, &seen)); err != nil {
-			errorLog.Println("couldn't check if fingerprint has been seen before (%v)", err)
+		// Items that were filtered or dropped as duplicates were never
+		// published, so there's nothing to edit. Readers haven't seen
+		// them, and they get the same checks as any new item.
+		if changed && previous.ID == "" {
+			changed = false
 		}
 
-		if seen {
+		if changed && r.edits == "revisions" {
+			r.reviseItem(previous.ID, makePlainText(item.Title), extractBody(item))
+			edited += 1
 			continue
-		} else {
-			newItems += 1
 		}
 
+		if r.filtered(feedUrl, item) {
+			filtered += 1
+			continue
+		}
+
+		// A republished item is sure to duplicate itself
+		var keys []string
+		if r.dedup != "" && !changed {
+			keys = dedupKeys(item)
+
+			var first uint64
+			if err := db.View(findDuplicate(r.Name, keys, time.Now().Add(-r.dedupWindow), &first)); err != nil {
+				errorLog.Printf("couldn't check for duplicates of %q (%v)", item.Link, err)
+			}
+			if first != 0 {
+				duplicates += 1
+				if r.dedup == "group" {
+					r.groupDuplicate(first, &Duplicate{
+						FeedURL:   feedUrl,
+						FeedTitle: feedUpdate.Title,
+						Title:     makePlainText(item.Title),
+						Link:      item.Link,
+						PubDate:   sanitizeDate(item.Published),
+					}, &feedUpdate)
+				}
+				continue
+			}
+		}
+		newItems += 1
+
 		itemUpdate := UpdatedFeedItem{
-			Body:      extractBody(item),
-			Link:      item.Link,
-			PermaLink: item.GUID,
-			PubDate:   sanitizeDate(item.Published),
-			Title:     makePlainText(item.Title),
+			Body:       extractBody(item),
+			Link:       item.Link,
+			PermaLink:  item.GUID,
+			PubDate:    sanitizeDate(item.Published),
+			Title:      makePlainText(item.Title),
+			Enclosures: itemEnclosures(item),
+			Duration:   itemDuration(item),
+			Image:      itemImage(item),
+		}
+
+		if changed {
+			itemUpdate.Updated = true
+			itemUpdate.OriginalID = previous.ID
+			edited += 1
 		}
 
 		if err := db.Update(assignNextID(r.Name, &itemUpdate)); err != nil {
 			errorLog.Printf("error assigning next ID (%v)", err)
 		}
 
+		if !changed {
+			if err := db.Batch(setFingerprintID(r.Name, fingerprint, itemUpdate.Id)); err != nil {
+				errorLog.Printf("couldn't record ID of %q (%v)", item.Link, err)
+			}
+		}
+
+		if len(keys) > 0 {
+			id, _ := strconv.ParseUint(itemUpdate.Id, 10, 64)
+			if err := db.Update(setDuplicateKeys(r.Name, keys, id)); err != nil {
+				errorLog.Printf("couldn't record %q for dedup (%v)", item.Link, err)
+			}
+		}
+
 		feedUpdate.Items = append([]*UpdatedFeedItem{&itemUpdate}, feedUpdate.Items...)
 	}
 
+	if reseed {
+		if err := db.Update(deleteReseed(r.Name, origin)); err != nil {
+			errorLog.Printf("couldn't clear reseeding of %q (%v)", feedUrl, err)
+		}
+	}
+
+	// Every new item goes into the archive, even those trimmed from
+	// the river below.
+	if newItems > 0 {
+		if err := db.Batch(archiveItems(r.Name, &feedUpdate)); err != nil {
+			errorLog.Printf("couldn't archive new items in river %s (%v)", r.Name, err)
+		}
+		r.indexItems(&feedUpdate)
+	}
+
 	if len(feedUpdate.Items) > maxItems {
 		feedUpdate.Items = feedUpdate.Items[:maxItems]
 	}
@@ -210,15 +607,27 @@ func (r *River) ProcessFeed(result FetchResult) {
 		if err := db.Batch(updateRiver(r.Name, &feedUpdate)); err != nil {
 			errorLog.Printf("couldn't add new items to river %s (%v)", r.Name, err)
 			logger.Printf("couldn't add new items to river %s (%v)", r.Name, err)
+		} else {
+			r.cache.invalidate()
+			r.events.publish(&feedUpdate)
+			r.queueWebhooks(&feedUpdate)
+			if r.hub != nil {
+				go r.hub.publish(r)
+			}
 		}
 	}
 
-	nextPoll := r.updatePollInterval(feedUrl, newItems)
-	logger.Printf("added %d new item(s) from %q to %s (next update = %v)", newItems, feedUrl, r.Name, nextPoll)
+	nextPoll := r.updatePollInterval(feedUrl, newItems+filtered+duplicates+edited)
+	r.updateStatus(result, filtered)
+	logger.Printf("added %d new item(s) from %q to %s (%d filtered, %d duplicate, %d edited, next update = %v)", newItems, feedUrl, r.Name, filtered, duplicates, edited, nextPoll)
 }
 
 func (r *River) updatePollInterval(url string, newItems int) time.Duration {
-	current := r.UpdateSchedule[url]
+	schedule, ok := r.UpdateSchedule[url]
+	if !ok {
+		return 0
+	}
+	current := schedule.Interval
 
 	chg := pollChange
 	if newItems > 0 {
@@ -235,10 +644,161 @@ func (r *River) updatePollInterval(url string, newItems int) time.Duration {
 		newPoll = pollMax
 	}
 
-	r.UpdateSchedule[url] = newPoll
-	r.Timers[url] = time.AfterFunc(newPoll, func() {
+	// The adaptive interval is kept for when the subscription lapses
+	wait := newPoll
+	if r.pushed(url) {
+		wait = websubPoll
+	}
+
+	now := time.Now()
+	r.feedsMu.Lock()
+	schedule.Interval = newPoll
+	schedule.LastFetch = now
+	schedule.NextFetch = now.Add(wait)
+	schedule.Failures = 0
+	schedule.Gone = 0
+	r.feedsMu.Unlock()
+	r.saveSchedule(url, schedule)
+
+	r.schedule(url, wait)
+
+	return wait
+}
+
+// backoff reschedules a feed whose fetch failed, waiting exponentially
+// longer after each consecutive failure. The poll interval itself is
+// left alone so the feed picks up its old pace once it recovers. Feeds
+// that keep returning 404 or 410 are parked and not fetched again.
+func (r *River) backoff(result FetchResult) time.Duration {
+	url := result.URL
+	schedule, ok := r.UpdateSchedule[url]
+	if !ok {
+		return 0
+	}
+	r.feedsMu.Lock()
+	schedule.Failures += 1
+
+	// Only an unbroken run of 404s and 410s parks the feed
+	if result.StatusCode == http.StatusNotFound || result.StatusCode == http.StatusGone {
+		schedule.Gone += 1
+	} else {
+		schedule.Gone = 0
+	}
+	parked := schedule.Gone >= maxPermanentFailures
+	if parked {
+		schedule.Parked = true
+		schedule.LastFetch = time.Now()
+		schedule.NextFetch = time.Time{}
+	}
+	r.feedsMu.Unlock()
+
+	if parked {
+		r.saveSchedule(url, schedule)
+
+		if timer, ok := r.Timers[url]; ok {
+			timer.Stop()
+			delete(r.Timers, url)
+		}
+		return 0
+	}
+
+	var wait time.Duration
+	if result.RetryAfter > 0 {
+		wait = result.RetryAfter
+	} else {
+		wait = backoffMin
+		for i := 1; i < schedule.Failures && wait < backoffMax; i++ {
+			wait *= 2
+		}
+		wait = wait/2 + jitter(wait/2)
+	}
+	if wait > backoffMax {
+		wait = backoffMax
+	}
+
+	now := time.Now()
+	r.feedsMu.Lock()
+	schedule.LastFetch = now
+	schedule.NextFetch = now.Add(wait)
+	r.feedsMu.Unlock()
+	r.saveSchedule(url, schedule)
+
+	r.schedule(url, wait)
+
+	return wait
+}
+
+// saveSchedule persists the schedule for url.
+func (r *River) saveSchedule(url string, schedule *FeedSchedule) {
+	if err := db.Batch(setSchedule(r.Name, url, schedule)); err != nil {
+		errorLog.Printf("couldn't store schedule for %q (%v)", url, err)
+	}
+}
+
+// recordRedirect remembers that url has permanently moved to movedTo
+// and, if the river is configured to, rewrites it in the config file.
+func (r *River) recordRedirect(url, movedTo string) {
+	logger.Printf("%q in %s permanently moved to %q", url, r.Name, movedTo)
+
+	if err := db.Update(setRedirect(r.Name, url, movedTo)); err != nil {
+		errorLog.Printf("couldn't record redirect for %q (%v)", url, err)
+		return
+	}
+
+	if r.rewriteRedirects {
+		if err := rewriteConfig(url, movedTo); err != nil {
+			errorLog.Printf("couldn't rewrite %q in %s (%v)", url, configPath, err)
+		}
+	}
+}
+
+// updateStatus records the outcome of a fetch in the feed's stored status.
+func (r *River) updateStatus(result FetchResult, filtered int) {
+	status := FeedStatus{URL: result.URL}
+	if err := db.View(getStatus(r.Name, result.URL, &status)); err != nil {
+		errorLog.Printf("couldn't load status for %q (%v)", result.URL, err)
+	}
+
+	now := time.Now()
+	status.LastStatus = result.StatusCode
+	if result.Err != nil {
+		status.LastError = result.Err.Error()
+		status.LastErrorTime = now
+		status.ConsecutiveFailures += 1
+	} else {
+		status.LastSuccess = now
+		status.ConsecutiveFailures = 0
+	}
+	if result.Feed != nil {
+		status.LastContent = now
+		status.ItemCount = len(result.Feed.Items)
+		status.LastFiltered = filtered
+		status.Filtered += filtered
+	}
+	if result.MovedTo != "" {
+		status.MovedTo = result.MovedTo
+	}
+	if result.Hub != "" {
+		status.Hub = result.Hub
+	}
+
+	if schedule, ok := r.UpdateSchedule[result.URL]; ok {
+		status.PollInterval = schedule.Interval.String()
+		status.NextFetch = schedule.NextFetch
+		status.Parked = schedule.Parked
+	}
+
+	if err := db.Batch(setStatus(r.Name, result.URL, &status)); err != nil {
+		errorLog.Printf("couldn't store status for %q (%v)", result.URL, err)
+	}
+}
+
+// schedule queues url for fetching after d, replacing any pending timer.
+func (r *River) schedule(url string, d time.Duration) {
+	if timer, ok := r.Timers[url]; ok {
+		timer.Stop()
+	}
+	r.Timers[url] = time.AfterFunc(d, func() {
 		r.Updater <- url
 	})
-
-	return newPoll
 }
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"github.com/boltdb/bolt"
+	"github.com/mmcdole/gofeed"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMain(m *testing.M) {
+	dir, err := ioutil.TempDir("", "colorado")
+	if err != nil {
+		log.Fatalln(err)
+	}
+
+	logger = log.New(ioutil.Discard, "", 0)
+	errorLog = log.New(ioutil.Discard, "", 0)
+	if db, err = bolt.Open(filepath.Join(dir, "feeds.db"), 0644, nil); err != nil {
+		log.Fatalln(err)
+	}
+	if searchDB, err = bolt.Open(filepath.Join(dir, "search.db"), 0644, nil); err != nil {
+		log.Fatalln(err)
+	}
+
+	code := m.Run()
+	db.Close()
+	searchDB.Close()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+// riverItems returns the titles of every item published to river name.
+func riverItems(t *testing.T, name string) []string {
+	var js RiverJS
+	if err := db.View(getRiver(name, &js)); err != nil {
+		t.Fatal(err)
+	}
+
+	var titles []string
+	for _, update := range js.UpdatedFeeds.UpdatedFeed {
+		for _, item := range update.Items {
+			titles = append(titles, item.Title)
+		}
+	}
+	return titles
+}
+
+func TestReseedDoesNotRepublish(t *testing.T) {
+	const (
+		name    = "reseed"
+		feedURL = "http://example.com/feed"
+	)
+
+	feed := &gofeed.Feed{
+		Title: "Example",
+		Items: []*gofeed.Item{
+			{Title: "Linked", Link: "http://example.com/linked"},
+			{Title: "UUID GUID", GUID: "0b1e5f7c-3a4d-4e2f-9c8b-7a6d5e4f3c2b"},
+			{Title: "Bare", Description: "No GUID or link"},
+		},
+	}
+
+	// Fingerprints as they were stored before content hashes: directly
+	// in the river's bucket, with bare items given random UUIDs.
+	if err := db.Update(createBucket(name)); err != nil {
+		t.Fatal(err)
+	}
+	err := db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket([]byte(name))
+		for _, key := range []string{
+			feedURL + ":http://example.com/linked",
+			feedURL + ":0b1e5f7c-3a4d-4e2f-9c8b-7a6d5e4f3c2b",
+			feedURL + ":5d9c2a1e-8f7b-4c6d-a3e2-1f0b9c8d7e6a",
+		} {
+			if err := b.Put([]byte(key), []byte{1}); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := NewRiver(RiverConfig{Name: name, Workers: 1}, []string{feedURL}, nil)
+	defer func() {
+		for _, timer := range r.Timers {
+			timer.Stop()
+		}
+	}()
+
+	var reseed bool
+	if err := db.View(getReseed(name, feedURL, &reseed)); err != nil {
+		t.Fatal(err)
+	}
+	if !reseed {
+		t.Fatal("random fingerprints migrated without marking the feed for reseeding")
+	}
+
+	// The reseed fetch and the ones after it publish nothing
+	for fetch := 1; fetch <= 2; fetch++ {
+		r.ProcessFeed(FetchResult{URL: feedURL, Feed: feed, StatusCode: http.StatusOK})
+		if titles := riverItems(t, name); len(titles) > 0 {
+			t.Fatalf("fetch %d republished %q", fetch, titles)
+		}
+	}
+
+	if err := db.View(getReseed(name, feedURL, &reseed)); err != nil {
+		t.Fatal(err)
+	}
+	if reseed {
+		t.Error("reseed mark not cleared after fetching")
+	}
+
+	// Items new since the reseed are published as usual
+	feed.Items = append([]*gofeed.Item{{Title: "Fresh", Description: "Brand new"}}, feed.Items...)
+	r.ProcessFeed(FetchResult{URL: feedURL, Feed: feed, StatusCode: http.StatusOK})
+	if titles := riverItems(t, name); len(titles) != 1 || titles[0] != "Fresh" {
+		t.Errorf("published %q after reseeding, want [Fresh]", titles)
+	}
+}
+
+func TestUpdateFeedsWhileServing(t *testing.T) {
+	const name = "reload"
+	feeds := []string{"http://example.com/a", "http://example.com/b"}
+
+	r := NewRiver(RiverConfig{Name: name, Workers: 1}, feeds, nil)
+	defer func() {
+		for _, timer := range r.Timers {
+			timer.Stop()
+		}
+	}()
+
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < 50; i++ {
+			r.updateFeeds(feeds[:1+i%2])
+		}
+		close(done)
+	}()
+
+	for {
+		select {
+		case <-done:
+			return
+		default:
+		}
+		r.hasFeed(feeds[1])
+		r.FeedCount()
+		if _, err := r.feedStatuses(); err != nil {
+			t.Fatal(err)
+		}
+		r.serveFeedsOpml(httptest.NewRecorder(), httptest.NewRequest("GET", "/"+name+"/feeds.opml", nil))
+	}
+}
@@ -0,0 +1,305 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	rssDocs      = "http://cyber.harvard.edu/rss/rss.html"
+	atomXMLNS    = "http://www.w3.org/2005/Atom"
+	tagAuthority = "colorado,2016" // for tag: URIs (RFC 4151)
+	itunesXMLNS  = "http://www.itunes.com/dtds/podcast-1.0.dtd"
+)
+
+type RSS struct {
+	XMLName     xml.Name   `xml:"rss"`
+	Version     string     `xml:"version,attr"`
+	XMLNSITunes string     `xml:"xmlns:itunes,attr"`
+	XMLNSAtom   string     `xml:"xmlns:atom,attr"`
+	Channel     RSSChannel `xml:"channel"`
+}
+
+type RSSChannel struct {
+	Title         string    `xml:"title"`
+	Link          string    `xml:"link"`
+	Description   string    `xml:"description"`
+	Generator     string    `xml:"generator"`
+	Docs          string    `xml:"docs"`
+	LastBuildDate string    `xml:"lastBuildDate"`
+	Items         []RSSItem `xml:"item"`
+}
+
+type RSSItem struct {
+	Title       string        `xml:"title,omitempty"`
+	Link        string        `xml:"link,omitempty"`
+	Description string        `xml:"description,omitempty"`
+	PubDate     string        `xml:"pubDate,omitempty"`
+	Enclosure   *RSSEnclosure `xml:"enclosure"`
+	GUID        RSSGUID       `xml:"guid"`
+	Source      RSSSource     `xml:"source"`
+	Duration    string        `xml:"itunes:duration,omitempty"`
+	Image       *ITunesImage  `xml:"itunes:image"`
+	Updated     string        `xml:"atom:updated,omitempty"` // when an edited item was last edited
+}
+
+// RSSEnclosure is the item's one enclosure; RSS doesn't allow more.
+type RSSEnclosure struct {
+	URL    string `xml:"url,attr"`
+	Length int64  `xml:"length,attr"`
+	Type   string `xml:"type,attr"`
+}
+
+type ITunesImage struct {
+	Href string `xml:"href,attr"`
+}
+
+type RSSGUID struct {
+	IsPermaLink string `xml:"isPermaLink,attr"`
+	Value       string `xml:",chardata"`
+}
+
+type RSSSource struct {
+	URL   string `xml:"url,attr"`
+	Title string `xml:",chardata"`
+}
+
+type AtomFeed struct {
+	XMLName   xml.Name    `xml:"feed"`
+	XMLNS     string      `xml:"xmlns,attr"`
+	ID        string      `xml:"id"`
+	Title     string      `xml:"title"`
+	Subtitle  string      `xml:"subtitle,omitempty"`
+	Updated   string      `xml:"updated"`
+	Generator string      `xml:"generator"`
+	Links     []AtomLink  `xml:"link"`
+	Entries   []AtomEntry `xml:"entry"`
+}
+
+type AtomEntry struct {
+	ID        string     `xml:"id"`
+	Title     string     `xml:"title"`
+	Updated   string     `xml:"updated"`
+	Published string     `xml:"published,omitempty"`
+	Links     []AtomLink `xml:"link"`
+	Summary   *AtomText  `xml:"summary,omitempty"`
+	Source    AtomSource `xml:"source"`
+}
+
+type AtomLink struct {
+	Rel    string `xml:"rel,attr,omitempty"`
+	Type   string `xml:"type,attr,omitempty"`
+	Length int64  `xml:"length,attr,omitempty"`
+	Href   string `xml:"href,attr"`
+}
+
+type AtomText struct {
+	Type string `xml:"type,attr"`
+	Body string `xml:",chardata"`
+}
+
+type AtomSource struct {
+	ID    string     `xml:"id"`
+	Title string     `xml:"title"`
+	Links []AtomLink `xml:"link"`
+}
+
+// outputItems returns the most recent archived items, grouped by the
+// feed update they came in with. Only the latest version of a
+// republished item is kept, since they share an outputID.
+func (r *River) outputItems() ([]*UpdatedFeed, error) {
+	js := r.newRiverJS()
+	if err := db.View(getArchive(r.Name, 0, maxArchiveItems, &js)); err != nil {
+		return nil, err
+	}
+
+	var updates []*UpdatedFeed
+	seen := make(map[string]bool)
+	for _, update := range js.UpdatedFeeds.UpdatedFeed {
+		var items []*UpdatedFeedItem
+		for _, item := range update.Items {
+			if !seen[outputID(item)] {
+				seen[outputID(item)] = true
+				items = append(items, item)
+			}
+		}
+		if len(items) > 0 {
+			update.Items = items
+			updates = append(updates, update)
+		}
+	}
+	return updates, nil
+}
+
+// itemGUID is the stable identifier for an item in this river's output
+// feeds. It isn't meant to be dereferenced.
+func (r *River) itemGUID(id string) string {
+	return r.stableID("/" + r.Name + "/items/" + id)
+}
+
+// stableID identifies path the same way however the river is reached:
+// under the base URL if there is one, or as a tag: URI otherwise, since
+// the host of the request varies between proxies and localhost.
+func (r *River) stableID(path string) string {
+	if r.baseURL != "" {
+		return r.baseURL + path
+	}
+	return "tag:" + tagAuthority + ":" + strings.TrimPrefix(path, "/")
+}
+
+// outputID is the ID an item goes by in the output feeds. Republished
+// items keep the ID they were first published under, so readers treat
+// them as updates rather than new items.
+func outputID(item *UpdatedFeedItem) string {
+	if item.OriginalID != "" {
+		return item.OriginalID
+	}
+	return item.Id
+}
+
+// whenEdited returns when an updated item was last edited, in
+// utcTimestampFmt, or "" if it never was.
+func whenEdited(update *UpdatedFeed, item *UpdatedFeedItem) string {
+	switch {
+	case !item.Updated:
+		return ""
+	case len(item.Revisions) > 0:
+		return item.Revisions[len(item.Revisions)-1].Revised
+	default:
+		return update.LastUpdate
+	}
+}
+
+// absURL resolves path against the configured base URL, or against the
+// host the request came in on if there isn't one.
+func (r *River) absURL(req *http.Request, path string) string {
+	if r.baseURL != "" || req == nil {
+		return r.baseURL + path
+	}
+	scheme := "http"
+	if req.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + req.Host + path
+}
+
+// rfc3339Date converts a date stored in utcTimestampFmt to RFC 3339.
+func rfc3339Date(date string) string {
+	parsed, err := time.Parse(utcTimestampFmt, date)
+	if err != nil {
+		return date
+	}
+	return parsed.UTC().Format(time.RFC3339)
+}
+
+// rssFeed builds the RSS 2.0 version of the river.
+func (r *River) rssFeed(req *http.Request) (*RSS, error) {
+	updates, err := r.outputItems()
+	if err != nil {
+		return nil, err
+	}
+
+	rss := RSS{
+		Version:     "2.0",
+		XMLNSITunes: itunesXMLNS,
+		XMLNSAtom:   atomXMLNS,
+		Channel: RSSChannel{
+			Title:         r.Title,
+			Link:          r.absURL(req, "/"+r.Name+"/"),
+			Description:   r.Description,
+			Generator:     userAgent,
+			Docs:          rssDocs,
+			LastBuildDate: nowGMT(),
+		},
+	}
+	if rss.Channel.Title == "" {
+		rss.Channel.Title = r.Name
+	}
+
+	for _, update := range updates {
+		for _, item := range update.Items {
+			rssItem := RSSItem{
+				Title:       item.Title,
+				Link:        item.Link,
+				Description: item.Body,
+				PubDate:     item.PubDate,
+				GUID:        RSSGUID{IsPermaLink: "false", Value: r.itemGUID(outputID(item))},
+				Source:      RSSSource{URL: update.URL, Title: update.Title},
+			}
+			if edited := whenEdited(update, item); edited != "" {
+				rssItem.Updated = rfc3339Date(edited)
+			}
+			if len(item.Enclosures) > 0 {
+				enclosure := item.Enclosures[0]
+				rssItem.Enclosure = &RSSEnclosure{URL: enclosure.URL, Length: enclosure.Length, Type: enclosure.mimeType()}
+			}
+			if item.Image != "" {
+				rssItem.Image = &ITunesImage{Href: item.Image}
+			}
+			rssItem.Duration = item.Duration
+			rss.Channel.Items = append(rss.Channel.Items, rssItem)
+		}
+	}
+
+	return &rss, nil
+}
+
+// atomFeed builds the Atom version of the river.
+func (r *River) atomFeed(req *http.Request) (*AtomFeed, error) {
+	updates, err := r.outputItems()
+	if err != nil {
+		return nil, err
+	}
+
+	feed := AtomFeed{
+		XMLNS:     atomXMLNS,
+		ID:        r.stableID("/" + r.Name + "/atom.xml"),
+		Title:     r.Title,
+		Subtitle:  r.Description,
+		Updated:   time.Now().UTC().Format(time.RFC3339),
+		Generator: userAgent,
+		Links: []AtomLink{
+			{Rel: "self", Type: "application/atom+xml", Href: r.absURL(req, "/"+r.Name+"/atom.xml")},
+			{Rel: "alternate", Type: "text/html", Href: r.absURL(req, "/"+r.Name+"/")},
+		},
+	}
+	if feed.Title == "" {
+		feed.Title = r.Name
+	}
+
+	for _, update := range updates {
+		for _, item := range update.Items {
+			entry := AtomEntry{
+				ID:        r.itemGUID(outputID(item)),
+				Title:     item.Title,
+				Updated:   rfc3339Date(update.LastUpdate),
+				Published: rfc3339Date(item.PubDate),
+				Source: AtomSource{
+					ID:    update.URL,
+					Title: update.Title,
+					Links: []AtomLink{
+						{Rel: "self", Href: update.URL},
+						{Rel: "alternate", Href: update.Website},
+					},
+				},
+			}
+			if edited := whenEdited(update, item); edited != "" {
+				entry.Updated = rfc3339Date(edited)
+			}
+			if item.Link != "" {
+				entry.Links = append(entry.Links, AtomLink{Rel: "alternate", Href: item.Link})
+			}
+			for _, enclosure := range item.Enclosures {
+				entry.Links = append(entry.Links, AtomLink{Rel: "enclosure", Type: enclosure.Type, Length: enclosure.Length, Href: enclosure.URL})
+			}
+			if item.Body != "" {
+				entry.Summary = &AtomText{Type: "html", Body: item.Body}
+			}
+			feed.Entries = append(feed.Entries, entry)
+		}
+	}
+
+	return &feed, nil
+}
@@ -0,0 +1,51 @@
+package main
+
+import (
+	"encoding/xml"
+	"github.com/mmcdole/gofeed"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestRSSMarksEdits(t *testing.T) {
+	const (
+		name    = "rss-edits"
+		feedURL = "http://example.com/feed"
+	)
+
+	r := NewRiver(RiverConfig{Name: name, Workers: 1, Edits: "republish"}, []string{feedURL}, nil)
+	defer func() {
+		for _, timer := range r.Timers {
+			timer.Stop()
+		}
+	}()
+
+	for _, title := range []string{"Council approves budget", "Council approves budget, corrected"} {
+		feed := &gofeed.Feed{Items: []*gofeed.Item{{GUID: "budget", Title: title}}}
+		r.ProcessFeed(FetchResult{URL: feedURL, Feed: feed, StatusCode: http.StatusOK})
+	}
+
+	rss, err := r.rssFeed(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rss.Channel.Items) != 1 {
+		t.Fatalf("RSS has %d item(s), want the edited one", len(rss.Channel.Items))
+	}
+	if rss.Channel.Items[0].Updated == "" {
+		t.Error("edited item has no atom:updated")
+	}
+
+	raw, err := xml.Marshal(rss)
+	if err != nil {
+		t.Fatal(err)
+	}
+	output := string(raw)
+	if !strings.Contains(output, `xmlns:atom="`+atomXMLNS+`"`) || !strings.Contains(output, "<atom:updated>") {
+		t.Errorf("RSS doesn't mark the edit with atom:updated:\n%s", output)
+	}
+	if strings.Contains(output, "<category>") {
+		t.Errorf("RSS marks the edit with a category:\n%s", output)
+	}
+}
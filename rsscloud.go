@@ -0,0 +1,174 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/rss"
+	"net"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// CloudRegistration is our standing request to be notified by an
+// rssCloud server when a feed changes.
+type CloudRegistration struct {
+	Server     string    `json:"server"`
+	URL        string    `json:"url"`
+	Registered time.Time `json:"registered"`
+}
+
+// live reports whether the cloud server should still be notifying us.
+func (c *CloudRegistration) live() bool {
+	return time.Since(c.Registered) < rssCloudExpiry
+}
+
+// notifyResult is the rssCloud server's answer to a registration.
+type notifyResult struct {
+	Success string `xml:"success,attr"`
+	Msg     string `xml:"msg,attr"`
+}
+
+// discoverCloud returns the <cloud> element of an RSS feed, which the
+// universal parser doesn't carry over.
+func discoverCloud(body []byte, feed *gofeed.Feed) *rss.Cloud {
+	if feed.FeedType != "rss" {
+		return nil
+	}
+	parsed, err := (&rss.Parser{}).Parse(bytes.NewReader(body))
+	if err != nil || parsed.Cloud == nil || parsed.Cloud.Domain == "" {
+		return nil
+	}
+	return parsed.Cloud
+}
+
+// ensureCloud registers for notifications from the feed's rssCloud
+// server, unless we registered recently enough. Only the REST
+// (http-post) protocol is supported, and like WebSub it needs a base
+// URL for the server to call back.
+func (r *River) ensureCloud(feedURL string, cloud *rss.Cloud) {
+	if r.baseURL == "" {
+		return
+	}
+	if cloud.Protocol != "http-post" {
+		logger.Printf("skipping rssCloud for %q (unsupported protocol %q)", feedURL, cloud.Protocol)
+		return
+	}
+
+	port := cloud.Port
+	if port == "" {
+		port = "80"
+	}
+	server := fmt.Sprintf("http://%s%s", net.JoinHostPort(cloud.Domain, port), cloud.Path)
+
+	var reg *CloudRegistration
+	if err := db.View(getCloudRegistration(r.Name, feedURL, &reg)); err != nil {
+		errorLog.Printf("couldn't load rssCloud registration for %q (%v)", feedURL, err)
+		return
+	}
+	if reg != nil && reg.Server == server && time.Since(reg.Registered) < rssCloudRenew {
+		return
+	}
+
+	// Register the URL the feed is actually fetched from
+	target := feedURL
+	if err := db.View(getRedirect(r.Name, feedURL, &target)); err != nil {
+		errorLog.Printf("couldn't look up redirect for %q (%v)", feedURL, err)
+	}
+
+	go func() {
+		if err := r.registerCloud(server, target); err != nil {
+			errorLog.Printf("couldn't register %q with rssCloud server %q (%v)", target, server, err)
+			return
+		}
+
+		reg := CloudRegistration{Server: server, URL: target, Registered: time.Now()}
+		if err := db.Update(setCloudRegistration(r.Name, feedURL, &reg)); err != nil {
+			errorLog.Printf("couldn't store rssCloud registration for %q (%v)", feedURL, err)
+			return
+		}
+		logger.Printf("registered %q with rssCloud server %q", target, server)
+	}()
+}
+
+// registerCloud asks server to notify us at /{river}/rsscloud when
+// feedURL changes.
+func (r *River) registerCloud(server, feedURL string) error {
+	base, err := url.Parse(r.baseURL)
+	if err != nil {
+		return err
+	}
+
+	port := base.Port()
+	if port == "" {
+		port = "80"
+		if base.Scheme == "https" {
+			port = "443"
+		}
+	}
+
+	form := url.Values{
+		"notifyProcedure": {""},
+		"domain":          {base.Hostname()},
+		"port":            {port},
+		"path":            {base.Path + "/" + r.Name + "/rsscloud"},
+		"protocol":        {"http-post"},
+		"url1":            {feedURL},
+	}
+
+	resp, err := r.httpClient.PostForm(server, form)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	var result notifyResult
+	if err := xml.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return fmt.Errorf("unexpected response %q", resp.Status)
+	}
+	if result.Success != "true" {
+		return fmt.Errorf("registration refused (%s)", result.Msg)
+	}
+	return nil
+}
+
+// cloudFeed finds the feed an rssCloud server is talking about, which
+// may be known to it by its redirected URL.
+func (r *River) cloudFeed(notified string) (string, bool) {
+	if r.hasFeed(notified) {
+		return notified, true
+	}
+	for _, feedURL := range r.feedURLs() {
+		target := feedURL
+		if err := db.View(getRedirect(r.Name, feedURL, &target)); err == nil && target == notified {
+			return feedURL, true
+		}
+	}
+	return "", false
+}
+
+// serveRSSCloud is the callback rssCloud servers use to verify our
+// registration (GET) and to tell us a feed has changed (POST).
+func (r *River) serveRSSCloud(w http.ResponseWriter, req *http.Request) {
+	feedURL, ok := r.cloudFeed(req.FormValue("url"))
+	if !ok {
+		http.NotFound(w, req)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		fmt.Fprint(w, req.FormValue("challenge"))
+	case "POST":
+		logger.Printf("rssCloud says %q in %s changed, fetching it now", feedURL, r.Name)
+		go func() {
+			r.Updater <- feedURL
+		}()
+		w.WriteHeader(http.StatusOK)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
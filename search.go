@@ -0,0 +1,171 @@
+package main
+
+import (
+	"fmt"
+	"html"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+)
+
+// byID sorts item IDs in ascending order.
+type byID []uint64
+
+func (s byID) Len() int           { return len(s) }
+func (s byID) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
+func (s byID) Less(i, j int) bool { return s[i] < s[j] }
+
+// searchTerms splits text into the lowercased words the search index is
+// keyed on, dropping duplicates and words too short or long to index.
+func searchTerms(text string) []string {
+	var terms []string
+	seen := make(map[string]bool)
+
+	words := strings.FieldsFunc(strings.ToLower(html.UnescapeString(text)), func(c rune) bool {
+		return !unicode.IsLetter(c) && !unicode.IsDigit(c)
+	})
+	for _, word := range words {
+		if len(word) < minTermLength || len(word) > maxTermLength || seen[word] {
+			continue
+		}
+		seen[word] = true
+		terms = append(terms, word)
+	}
+	return terms
+}
+
+// highlighter returns a regexp matching any of terms as a whole word.
+func highlighter(terms []string) *regexp.Regexp {
+	quoted := make([]string, len(terms))
+	for i, term := range terms {
+		quoted[i] = regexp.QuoteMeta(term)
+	}
+	return regexp.MustCompile(`(?i)\b(` + strings.Join(quoted, "|") + `)\b`)
+}
+
+// highlight wraps every match of the search terms in the title and body
+// of the results in <mark>.
+func highlight(js *RiverJS, terms []string) {
+	re := highlighter(terms)
+	for _, update := range js.UpdatedFeeds.UpdatedFeed {
+		for _, item := range update.Items {
+			item.Title = re.ReplaceAllString(item.Title, "<mark>$1</mark>")
+			item.Body = re.ReplaceAllString(item.Body, "<mark>$1</mark>")
+		}
+	}
+}
+
+// indexItems adds the new items of update to the search index.
+func (r *River) indexItems(update *UpdatedFeed) {
+	if err := searchDB.Batch(indexItems(r.Name, update)); err != nil {
+		errorLog.Printf("couldn't index new items in river %s (%v)", r.Name, err)
+	}
+}
+
+// reindex adds every archived item to a new search index, so rivers
+// that predate it can be searched from the start.
+func (r *River) reindex() {
+	var updates []*UpdatedFeed
+	if err := db.View(getAllItems(r.Name, &updates)); err != nil {
+		errorLog.Printf("couldn't load archived items in river %s (%v)", r.Name, err)
+		return
+	}
+	if len(updates) == 0 {
+		return
+	}
+
+	if err := searchDB.Update(indexItems(r.Name, updates...)); err != nil {
+		errorLog.Printf("couldn't index archived items in river %s (%v)", r.Name, err)
+		return
+	}
+	logger.Printf("indexed %d archived item(s) in river %s", len(updates), r.Name)
+}
+
+// parseDay parses a YYYY-MM-DD query parameter, returning the zero time
+// if it's empty.
+func parseDay(value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse("2006-01-02", value)
+}
+
+// serveSearch serves the items matching every word of ?q=, newest first,
+// in the same shape as the river. ?since= and ?until= (YYYY-MM-DD, UTC)
+// limit results to items that arrived on those days, and ?callback=
+// wraps them for JSONP.
+func (r *River) serveSearch(w http.ResponseWriter, req *http.Request) {
+	query := req.URL.Query()
+
+	terms := searchTerms(query.Get("q"))
+	if len(terms) == 0 {
+		http.Error(w, "missing search terms", http.StatusBadRequest)
+		return
+	}
+
+	since, err := parseDay(query.Get("since"))
+	if err != nil {
+		http.Error(w, "invalid since", http.StatusBadRequest)
+		return
+	}
+	until, err := parseDay(query.Get("until"))
+	if err != nil {
+		http.Error(w, "invalid until", http.StatusBadRequest)
+		return
+	}
+
+	callback := query.Get("callback")
+	if callback != "" && (len(callback) > maxCallbackLength || !validCallback.MatchString(callback)) {
+		http.Error(w, "invalid callback", http.StatusBadRequest)
+		return
+	}
+
+	var lo, hi uint64
+	if err := db.View(dayRange(r.Name, since, until, &lo, &hi)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var ids []uint64
+	if err := searchDB.View(searchIndex(r.Name, terms, lo, hi, &ids)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	js := r.newRiverJS()
+	js.Metadata["query"] = strings.Join(terms, " ")
+	js.Metadata["hits"] = strconv.Itoa(len(ids))
+
+	// ?before=<id> pages back through the results like the river does
+	if before := query.Get("before"); before != "" {
+		id, err := strconv.ParseUint(before, 10, 64)
+		if err != nil {
+			http.Error(w, "invalid before", http.StatusBadRequest)
+			return
+		}
+		for len(ids) > 0 && ids[0] >= id {
+			ids = ids[1:]
+		}
+	}
+	if len(ids) > maxSearchResults {
+		ids = ids[:maxSearchResults]
+		js.Metadata["nextBefore"] = fmt.Sprint(ids[len(ids)-1])
+	}
+
+	if err := db.View(getItems(r.Name, ids, &js)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	highlight(&js, terms)
+
+	if callback == "" {
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+		w.Header().Set("Access-Control-Allow-Origin", "*")
+	} else {
+		w.Header().Set("Content-Type", "application/javascript; charset=utf-8")
+	}
+	writeCallback(w, callback, js)
+}
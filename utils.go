@@ -1,10 +1,17 @@
 package main
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
 	"encoding/xml"
+	"fmt"
 	"github.com/microcosm-cc/bluemonday"
+	"github.com/mmcdole/gofeed"
 	"golang.org/x/net/html/charset"
+	"io"
+	"math/rand"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
@@ -17,6 +24,85 @@ func nowLocal() string {
 	return time.Now().Format(localTimestampFmt)
 }
 
+// jitter returns a random duration in [0, d).
+func jitter(d time.Duration) time.Duration {
+	if d <= 0 {
+		return 0
+	}
+	return time.Duration(rand.Int63n(int64(d)))
+}
+
+// parseRetryAfter returns how long a Retry-After header asks us to wait.
+// It accepts either delay-seconds or an HTTP date.
+func parseRetryAfter(value string) time.Duration {
+	if seconds, err := strconv.Atoi(value); err == nil && seconds > 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if when, err := http.ParseTime(value); err == nil {
+		return time.Until(when)
+	}
+	return 0
+}
+
+// permanentRedirect returns the URL resp was served from if every
+// redirect leading to it was permanent (301 or 308), and "" otherwise.
+func permanentRedirect(resp *http.Response) string {
+	if resp.Request.Response == nil {
+		return ""
+	}
+	for prev := resp.Request.Response; prev != nil; prev = prev.Request.Response {
+		if prev.StatusCode != http.StatusMovedPermanently && prev.StatusCode != http.StatusPermanentRedirect {
+			return ""
+		}
+	}
+	return resp.Request.URL.String()
+}
+
+// generateFingerprint identifies item in the feed at url by its GUID,
+// link or, lacking both, its content.
+func generateFingerprint(url string, item *gofeed.Item) string {
+	var guid string
+
+	switch {
+	case item.GUID != "":
+		guid = item.GUID
+	case item.Link != "":
+		guid = item.Link
+	default:
+		guid = contentHash(item)
+	}
+
+	return fmt.Sprintf("%s:%s", url, guid)
+}
+
+// contentHash identifies an item with neither GUID nor link by its
+// title, body, enclosures and publication date, so it fingerprints the
+// same way on every fetch. The updated date is left out since feeds
+// bump it without changing anything else.
+func contentHash(item *gofeed.Item) string {
+	h := sha1.New()
+	fields := []string{item.Title, item.Description, item.Content, item.Published}
+	for _, enclosure := range item.Enclosures {
+		fields = append(fields, enclosure.URL, enclosure.Type, enclosure.Length)
+	}
+	for _, field := range fields {
+		io.WriteString(h, field)
+		h.Write([]byte{0})
+	}
+	return "sha1:" + hex.EncodeToString(h.Sum(nil))
+}
+
+// revisionHash identifies the visible content of an item, so edits can
+// be told apart from feeds that merely regenerate their markup or dates.
+func revisionHash(item *gofeed.Item) string {
+	h := sha1.New()
+	for _, field := range []string{item.Title, item.Description, item.Content} {
+		io.WriteString(h, makePlainText(field))
+		h.Write([]byte{0})
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
 func sanitizeDate(date string) string {
 	formats := []string{
 		"Mon, 02 Jan 2006 15:04:05 UTC",
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"github.com/mmcdole/gofeed"
+	"testing"
+)
+
+func bareItem() *gofeed.Item {
+	return &gofeed.Item{
+		Title:       "Episode 12",
+		Description: "<p>In which nothing happens.</p>",
+		Published:   "Mon, 02 Jan 2017 15:04:05 GMT",
+		Enclosures: []*gofeed.Enclosure{
+			{URL: "http://example.com/12.mp3", Type: "audio/mpeg", Length: "1024"},
+		},
+	}
+}
+
+func TestGenerateFingerprintStable(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*gofeed.Item)
+	}{
+		{"unchanged", func(item *gofeed.Item) {}},
+		{"updated date", func(item *gofeed.Item) { item.Updated = "Tue, 03 Jan 2017 15:04:05 GMT" }},
+		{"author", func(item *gofeed.Item) { item.Author = &gofeed.Person{Name: "Someone"} }},
+	}
+
+	want := generateFingerprint("http://example.com/feed", bareItem())
+	for _, test := range tests {
+		item := bareItem()
+		test.edit(item)
+		if got := generateFingerprint("http://example.com/feed", item); got != want {
+			t.Errorf("%s: fingerprint = %q, want %q", test.name, got, want)
+		}
+	}
+}
+
+func TestGenerateFingerprintDiffers(t *testing.T) {
+	tests := []struct {
+		name string
+		edit func(*gofeed.Item)
+	}{
+		{"title", func(item *gofeed.Item) { item.Title = "Episode 13" }},
+		{"description", func(item *gofeed.Item) { item.Description = "<p>In which something happens.</p>" }},
+		{"content", func(item *gofeed.Item) { item.Content = "<p>Show notes</p>" }},
+		{"published", func(item *gofeed.Item) { item.Published = "Mon, 09 Jan 2017 15:04:05 GMT" }},
+		{"enclosure url", func(item *gofeed.Item) { item.Enclosures[0].URL = "http://example.com/13.mp3" }},
+		{"enclosure length", func(item *gofeed.Item) { item.Enclosures[0].Length = "2048" }},
+		{"no enclosure", func(item *gofeed.Item) { item.Enclosures = nil }},
+		// Fields run together the same way must still differ
+		{"shifted fields", func(item *gofeed.Item) {
+			item.Title, item.Description = "Episode 12<p>In which nothing happens.</p>", ""
+		}},
+	}
+
+	original := generateFingerprint("http://example.com/feed", bareItem())
+	for _, test := range tests {
+		item := bareItem()
+		test.edit(item)
+		if got := generateFingerprint("http://example.com/feed", item); got == original {
+			t.Errorf("%s: fingerprint didn't change from %q", test.name, original)
+		}
+	}
+}
+
+func TestGenerateFingerprintPrefersGUID(t *testing.T) {
+	tests := []struct {
+		guid, link string
+		want       string
+	}{
+		{"urn:uuid:1", "http://example.com/1", "http://example.com/feed:urn:uuid:1"},
+		{"", "http://example.com/1", "http://example.com/feed:http://example.com/1"},
+		{"", "", "http://example.com/feed:" + contentHash(bareItem())},
+	}
+
+	for _, test := range tests {
+		item := bareItem()
+		item.GUID, item.Link = test.guid, test.link
+		if got := generateFingerprint("http://example.com/feed", item); got != test.want {
+			t.Errorf("generateFingerprint(guid %q, link %q) = %q, want %q", test.guid, test.link, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// webhookDelivery is a queued POST of one feed update to one webhook.
+type webhookDelivery struct {
+	ID          uint64          `json:"-"`
+	URL         string          `json:"url"`
+	Payload     json.RawMessage `json:"payload"`
+	Attempts    int             `json:"attempts"`
+	NextAttempt time.Time       `json:"nextAttempt"`
+}
+
+// webhookPayload is the JSON body POSTed to webhooks.
+type webhookPayload struct {
+	River  string       `json:"river"`
+	Update *UpdatedFeed `json:"update"`
+}
+
+// queueWebhooks queues update for delivery to each of the river's
+// webhooks and wakes the worker.
+func (r *River) queueWebhooks(update *UpdatedFeed) {
+	if len(r.webhooks) == 0 {
+		return
+	}
+
+	payload, err := json.Marshal(webhookPayload{River: r.Name, Update: update})
+	if err != nil {
+		errorLog.Printf("couldn't encode webhook payload for %s (%v)", r.Name, err)
+		return
+	}
+
+	for _, hook := range r.webhooks {
+		delivery := webhookDelivery{URL: hook.URL, Payload: payload, NextAttempt: time.Now()}
+		if err := db.Batch(enqueueWebhook(r.Name, &delivery)); err != nil {
+			errorLog.Printf("couldn't queue webhook to %q for %s (%v)", hook.URL, r.Name, err)
+		}
+	}
+
+	select {
+	case r.webhookWake <- true:
+	default:
+	}
+}
+
+// WebhookWorker delivers queued webhooks whenever new ones are queued,
+// and once every webhookPoll to pick up retries.
+func (r *River) WebhookWorker() {
+	ticker := time.NewTicker(webhookPoll)
+	defer ticker.Stop()
+
+	for {
+		var due []*webhookDelivery
+		if err := db.View(dueWebhooks(r.Name, time.Now(), &due)); err != nil {
+			errorLog.Printf("couldn't read webhook queue for %s (%v)", r.Name, err)
+		}
+
+		for _, delivery := range due {
+			r.deliverWebhook(delivery)
+		}
+
+		select {
+		case <-r.webhookWake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// deliverWebhook attempts a single delivery, removing it from the queue
+// once it succeeds or runs out of attempts, and rescheduling it otherwise.
+func (r *River) deliverWebhook(delivery *webhookDelivery) {
+	var secret string
+	var configured bool
+	for _, hook := range r.webhooks {
+		if hook.URL == delivery.URL {
+			secret, configured = hook.Secret, true
+		}
+	}
+
+	err := fmt.Errorf("webhook no longer configured")
+	if configured {
+		err = r.postWebhook(delivery, secret)
+	}
+
+	delivery.Attempts += 1
+	switch {
+	case err == nil:
+		logger.Printf("delivered webhook %d to %q for %s", delivery.ID, delivery.URL, r.Name)
+	case !configured || delivery.Attempts >= maxWebhookAttempts:
+		errorLog.Printf("giving up on webhook %d to %q for %s after %d attempt(s) (%v)", delivery.ID, delivery.URL, r.Name, delivery.Attempts, err)
+	default:
+		wait := webhookRetryMin
+		for i := 1; i < delivery.Attempts && wait < webhookRetryMax; i++ {
+			wait *= 2
+		}
+		if wait > webhookRetryMax {
+			wait = webhookRetryMax
+		}
+		delivery.NextAttempt = time.Now().Add(wait/2 + jitter(wait/2))
+
+		errorLog.Printf("couldn't deliver webhook %d to %q for %s (%v, next attempt = %v)", delivery.ID, delivery.URL, r.Name, err, delivery.NextAttempt)
+		if err := db.Batch(updateWebhook(r.Name, delivery)); err != nil {
+			errorLog.Printf("couldn't reschedule webhook %d for %s (%v)", delivery.ID, r.Name, err)
+		}
+		return
+	}
+
+	if err := db.Batch(deleteWebhook(r.Name, delivery.ID)); err != nil {
+		errorLog.Printf("couldn't remove webhook %d for %s (%v)", delivery.ID, r.Name, err)
+	}
+}
+
+// postWebhook POSTs the delivery's payload, signed with an HMAC-SHA256
+// of the body in X-Colorado-Signature.
+func (r *River) postWebhook(delivery *webhookDelivery, secret string) error {
+	req, err := http.NewRequest("POST", delivery.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Colorado-Delivery", strconv.FormatUint(delivery.ID, 10))
+	if secret != "" {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write(delivery.Payload)
+		req.Header.Set("X-Colorado-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := r.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("unexpected status %q", resp.Status)
+	}
+	return nil
+}
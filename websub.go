@@ -0,0 +1,306 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"github.com/mmcdole/gofeed"
+	"github.com/mmcdole/gofeed/atom"
+	"hash"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Subscription is a WebSub subscription to a feed's hub. A renewal's
+// PendingSecret only replaces Secret once the hub verifies it, since the
+// hub keeps signing with the old one until then.
+type Subscription struct {
+	Hub           string    `json:"hub"`
+	Topic         string    `json:"topic"`
+	Secret        string    `json:"secret"`
+	PendingSecret string    `json:"pendingSecret,omitempty"`
+	Active        bool      `json:"active"`
+	Expires       time.Time `json:"expires"`
+}
+
+// live reports whether the hub is currently pushing the feed to us.
+func (s *Subscription) live() bool {
+	return s.Active && time.Now().Before(s.Expires)
+}
+
+// parseLinkHeader returns the first URL for each rel in the Link headers.
+func parseLinkHeader(values []string) map[string]string {
+	links := make(map[string]string)
+	for _, value := range values {
+		for _, link := range strings.Split(value, ",") {
+			parts := strings.Split(link, ";")
+			target := strings.Trim(strings.TrimSpace(parts[0]), "<>")
+			for _, param := range parts[1:] {
+				param = strings.TrimSpace(param)
+				if !strings.HasPrefix(param, "rel=") {
+					continue
+				}
+				for _, rel := range strings.Fields(strings.Trim(param[4:], `"`)) {
+					if _, ok := links[rel]; !ok {
+						links[rel] = target
+					}
+				}
+			}
+		}
+	}
+	return links
+}
+
+// discoverHub finds the WebSub hub and topic a feed advertises, either
+// in its Link headers or as atom:link elements. The topic defaults to
+// the URL the feed was fetched from.
+func discoverHub(resp *http.Response, body []byte, feed *gofeed.Feed) (hub, topic string) {
+	links := parseLinkHeader(resp.Header["Link"])
+
+	// RSS feeds carry atom:link as an extension, while the universal
+	// parser drops the rel of an Atom feed's own links.
+	for _, ext := range feed.Extensions["atom"]["link"] {
+		if _, ok := links[ext.Attrs["rel"]]; !ok {
+			links[ext.Attrs["rel"]] = ext.Attrs["href"]
+		}
+	}
+	if feed.FeedType == "atom" {
+		if parsed, err := (&atom.Parser{}).Parse(bytes.NewReader(body)); err == nil {
+			for _, link := range parsed.Links {
+				if _, ok := links[link.Rel]; !ok {
+					links[link.Rel] = link.Href
+				}
+			}
+		}
+	}
+
+	hub, topic = links["hub"], links["self"]
+	if topic == "" {
+		topic = resp.Request.URL.String()
+	}
+	return hub, topic
+}
+
+// websubCallback is the callback URL the hub is given for feedURL.
+func (r *River) websubCallback(feedURL string) string {
+	return r.baseURL + "/" + r.Name + "/websub?feed=" + url.QueryEscape(feedURL)
+}
+
+// pushed reports whether we're told about changes to feedURL by its
+// WebSub hub or rssCloud server, in which case polling drops back to
+// websubPoll.
+func (r *River) pushed(feedURL string) bool {
+	var sub *Subscription
+	if err := db.View(getSubscription(r.Name, feedURL, &sub)); err != nil {
+		errorLog.Printf("couldn't load subscription for %q (%v)", feedURL, err)
+	}
+	if sub != nil && sub.live() {
+		return true
+	}
+
+	var reg *CloudRegistration
+	if err := db.View(getCloudRegistration(r.Name, feedURL, &reg)); err != nil {
+		errorLog.Printf("couldn't load rssCloud registration for %q (%v)", feedURL, err)
+	}
+	return reg != nil && reg.live()
+}
+
+// ensureSubscription subscribes to feedURL's hub unless there's already
+// a live subscription that isn't due for renewal. It's a no-op without
+// a base URL, since the hub would have nowhere to call back.
+func (r *River) ensureSubscription(feedURL, hub, topic string) {
+	if r.baseURL == "" {
+		return
+	}
+
+	var sub *Subscription
+	if err := db.View(getSubscription(r.Name, feedURL, &sub)); err != nil {
+		errorLog.Printf("couldn't load subscription for %q (%v)", feedURL, err)
+		return
+	}
+	if sub != nil && sub.Hub == hub && sub.Topic == topic && time.Until(sub.Expires) > websubRenew {
+		return
+	}
+
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		errorLog.Printf("couldn't generate secret for %q (%v)", feedURL, err)
+		return
+	}
+
+	// Keep accepting pushes into the old subscription, signed with the
+	// old secret, until the new one is verified
+	pending := Subscription{Hub: hub, Topic: topic}
+	if sub != nil && sub.Hub == hub && sub.Topic == topic {
+		pending = *sub
+	}
+	pending.PendingSecret = hex.EncodeToString(secret)
+	if err := db.Update(setSubscription(r.Name, feedURL, &pending)); err != nil {
+		errorLog.Printf("couldn't store subscription for %q (%v)", feedURL, err)
+		return
+	}
+
+	go func() {
+		form := url.Values{
+			"hub.callback":      {r.websubCallback(feedURL)},
+			"hub.mode":          {"subscribe"},
+			"hub.topic":         {topic},
+			"hub.lease_seconds": {strconv.Itoa(int(websubLease.Seconds()))},
+			"hub.secret":        {pending.PendingSecret},
+		}
+
+		resp, err := r.httpClient.PostForm(hub, form)
+		if err != nil {
+			errorLog.Printf("couldn't subscribe to %q at %q (%v)", topic, hub, err)
+			return
+		}
+		resp.Body.Close()
+
+		if resp.StatusCode != http.StatusAccepted && resp.StatusCode != http.StatusNoContent {
+			errorLog.Printf("couldn't subscribe to %q at %q (unexpected status %q)", topic, hub, resp.Status)
+			return
+		}
+		logger.Printf("requested WebSub subscription to %q at %q", topic, hub)
+	}()
+}
+
+// verifySignature checks the X-Hub-Signature of a content distribution
+// against the subscription's secret.
+func verifySignature(header, secret string, body []byte) bool {
+	parts := strings.SplitN(header, "=", 2)
+	if len(parts) != 2 {
+		return false
+	}
+
+	var h func() hash.Hash
+	switch parts[0] {
+	case "sha1":
+		h = sha1.New
+	case "sha256":
+		h = sha256.New
+	default:
+		return false
+	}
+
+	expected, err := hex.DecodeString(parts[1])
+	if err != nil {
+		return false
+	}
+
+	mac := hmac.New(h, []byte(secret))
+	mac.Write(body)
+	return hmac.Equal(mac.Sum(nil), expected)
+}
+
+// serveWebSub is the callback hubs use to verify our subscription
+// intents (GET) and to push new content to us (POST).
+func (r *River) serveWebSub(w http.ResponseWriter, req *http.Request) {
+	feedURL := req.URL.Query().Get("feed")
+
+	var sub *Subscription
+	if err := db.View(getSubscription(r.Name, feedURL, &sub)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch req.Method {
+	case "GET":
+		r.verifyIntent(w, req, feedURL, sub)
+	case "POST":
+		r.receiveContent(w, req, feedURL, sub)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *River) verifyIntent(w http.ResponseWriter, req *http.Request, feedURL string, sub *Subscription) {
+	query := req.URL.Query()
+	mode, topic := query.Get("hub.mode"), query.Get("hub.topic")
+
+	switch mode {
+	case "subscribe":
+		if sub == nil || sub.Topic != topic || !r.hasFeed(feedURL) {
+			http.NotFound(w, req)
+			return
+		}
+
+		lease, err := strconv.Atoi(query.Get("hub.lease_seconds"))
+		if err != nil || lease <= 0 {
+			lease = int(websubLease.Seconds())
+		}
+		sub.Active = true
+		sub.Expires = time.Now().Add(time.Duration(lease) * time.Second)
+		if sub.PendingSecret != "" {
+			sub.Secret, sub.PendingSecret = sub.PendingSecret, ""
+		}
+		if err := db.Update(setSubscription(r.Name, feedURL, sub)); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		logger.Printf("WebSub subscription to %q for %s verified until %v", topic, r.Name, sub.Expires)
+
+	case "unsubscribe":
+		// Only agree to unsubscribe from feeds we no longer want
+		if sub != nil && r.hasFeed(feedURL) {
+			http.NotFound(w, req)
+			return
+		}
+
+	case "denied":
+		logger.Printf("WebSub subscription to %q for %s denied (%s)", topic, r.Name, query.Get("hub.reason"))
+		if err := db.Update(deleteSubscription(r.Name, feedURL)); err != nil {
+			errorLog.Printf("couldn't delete subscription for %q (%v)", feedURL, err)
+		}
+		return
+
+	default:
+		http.Error(w, "invalid hub.mode", http.StatusBadRequest)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	fmt.Fprint(w, query.Get("hub.challenge"))
+}
+
+func (r *River) receiveContent(w http.ResponseWriter, req *http.Request, feedURL string, sub *Subscription) {
+	// 410 tells the hub to stop pushing feeds we've dropped
+	if sub == nil || !r.hasFeed(feedURL) {
+		http.Error(w, "no such subscription", http.StatusGone)
+		return
+	}
+
+	body, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	// Content with a bad signature is acknowledged but ignored, as the
+	// spec asks. A subscription that hasn't been verified has no secret
+	// yet, and an empty key would let anyone sign a push.
+	w.WriteHeader(http.StatusAccepted)
+	signature := req.Header.Get("X-Hub-Signature")
+	current := sub.live() && sub.Secret != "" && verifySignature(signature, sub.Secret, body)
+	pending := sub.PendingSecret != "" && verifySignature(signature, sub.PendingSecret, body)
+	if !current && !pending {
+		errorLog.Printf("ignoring WebSub push for %q with bad signature", feedURL)
+		return
+	}
+
+	feed, err := gofeed.NewParser().Parse(bytes.NewReader(body))
+	if err != nil {
+		errorLog.Printf("error parsing WebSub push for %q (%v)", feedURL, err)
+		return
+	}
+
+	logger.Printf("received WebSub push for %q in %s", feedURL, r.Name)
+	r.FetchResults <- FetchResult{URL: feedURL, Feed: feed, StatusCode: http.StatusOK}
+}
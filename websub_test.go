@@ -0,0 +1,71 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sign(secret, body string) string {
+	mac := hmac.New(sha1.New, []byte(secret))
+	mac.Write([]byte(body))
+	return "sha1=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestReceiveContentSignatures(t *testing.T) {
+	const (
+		name    = "websub"
+		feedURL = "http://example.com/feed"
+		body    = `<rss version="2.0"><channel><title>Example</title><item><title>Pushed</title></item></channel></rss>`
+	)
+
+	r := NewRiver(RiverConfig{Name: name, Workers: 1}, []string{feedURL}, nil)
+	later := time.Now().Add(time.Hour)
+
+	tests := []struct {
+		name      string
+		sub       Subscription
+		signature string
+		accepted  bool
+	}{
+		{"unverified, empty key", Subscription{}, sign("", body), false},
+		{"unverified, pending secret", Subscription{PendingSecret: "new"}, sign("new", body), true},
+		{"live, secret", Subscription{Secret: "old", Active: true, Expires: later}, sign("old", body), true},
+		{"live, wrong secret", Subscription{Secret: "old", Active: true, Expires: later}, sign("other", body), false},
+		{"live, empty key", Subscription{Secret: "", Active: true, Expires: later}, sign("", body), false},
+		{"expired, secret", Subscription{Secret: "old", Active: true, Expires: time.Now().Add(-time.Hour)}, sign("old", body), false},
+		{"renewing, old secret", Subscription{Secret: "old", PendingSecret: "new", Active: true, Expires: later}, sign("old", body), true},
+	}
+
+	for _, test := range tests {
+		sub := test.sub
+		if err := db.Update(setSubscription(name, feedURL, &sub)); err != nil {
+			t.Fatal(err)
+		}
+
+		req := httptest.NewRequest("POST", "/"+name+"/websub?feed="+url.QueryEscape(feedURL), strings.NewReader(body))
+		req.Header.Set("X-Hub-Signature", test.signature)
+		w := httptest.NewRecorder()
+		r.serveWebSub(w, req)
+
+		if w.Code != http.StatusAccepted {
+			t.Errorf("%s: status = %d, want %d", test.name, w.Code, http.StatusAccepted)
+		}
+
+		var accepted bool
+		select {
+		case <-r.FetchResults:
+			accepted = true
+		default:
+		}
+		if accepted != test.accepted {
+			t.Errorf("%s: accepted = %v, want %v", test.name, accepted, test.accepted)
+		}
+	}
+}